@@ -1,19 +1,17 @@
 package main
 
 import (
-	"log/slog"
 	"net/http"
 
 	"github.com/rsmaxwell/mqtt-rpc-go/internal/buildinfo"
-	"github.com/rsmaxwell/mqtt-rpc-go/internal/request"
-	"github.com/rsmaxwell/mqtt-rpc-go/internal/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
 )
 
 type BuildInfoHandler struct {
 }
 
 func (h *BuildInfoHandler) Handle(req request.Request) (*response.Response, bool, error) {
-	slog.Info("BuildInfoHandler")
 
 	info := buildinfo.NewBuildInfo()
 
@@ -21,3 +19,8 @@ func (h *BuildInfoHandler) Handle(req request.Request) (*response.Response, bool
 	r.PutBuildInfo(info)
 	return r, false, nil
 }
+
+// Deduplicate opts out of duplicate suppression, since the build info is read only
+func (h *BuildInfoHandler) Deduplicate() bool {
+	return false
+}
@@ -1,67 +1,40 @@
 package main
 
 import (
-	"fmt"
-	"log"
-	"log/slog"
-	"net/http"
+	"context"
 
-	"github.com/rsmaxwell/mqtt-rpc-go/internal/request"
-	"github.com/rsmaxwell/mqtt-rpc-go/internal/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
 )
 
-type CalculatorHandler struct {
+type CalculatorRequest struct {
+	Operation string `json:"operation"`
+	Param1    int64  `json:"param1"`
+	Param2    int64  `json:"param2"`
 }
 
-func (h *CalculatorHandler) Handle(req request.Request) (resp *response.Response, quit bool, err error) {
-	slog.Info("CalculatorHandler")
-
-	operation, err := req.GetString("operation")
-	if err != nil {
-		resp := response.New(http.StatusBadRequest)
-		resp.PutMessage(fmt.Sprintf("could not find 'operation' in arguments: %s", err))
-		return resp, false, nil
-	}
-
-	param1, err := req.GetInteger("param1")
-	if err != nil {
-		resp := response.New(http.StatusBadRequest)
-		resp.PutMessage(fmt.Sprintf("could not find 'param1' in arguments: %s", err))
-		return resp, false, nil
-	}
-
-	param2, err := req.GetInteger("param2")
-	if err != nil {
-		resp := response.New(http.StatusBadRequest)
-		resp.PutMessage(fmt.Sprintf("could not find 'param2' in arguments: %s", err))
-		return resp, false, nil
-	}
+type CalculatorResponse struct {
+	Result int64 `json:"result"`
+}
 
-	defer func() {
-		if r := recover(); r != nil {
-			errorText := fmt.Sprintf("%s", r)
-			log.Println("RECOVER", errorText)
-			resp = response.New(http.StatusBadRequest)
-			resp.PutMessage(errorText)
-			quit = false
-			err = nil
-		}
-	}()
+func Calculator(ctx context.Context, in CalculatorRequest) (CalculatorResponse, error) {
 
-	var value int64
+	var out CalculatorResponse
 
-	switch operation {
+	switch in.Operation {
 	case "add":
-		value = param1 + param2
+		out.Result = in.Param1 + in.Param2
 	case "mul":
-		value = param1 * param2
+		out.Result = in.Param1 * in.Param2
 	case "div":
-		value = param1 / param2
+		if in.Param2 == 0 {
+			return out, rpcerr.New(rpcerr.InvalidArgument, "division by zero")
+		}
+		out.Result = in.Param1 / in.Param2
 	case "sub":
-		value = param1 - param2
+		out.Result = in.Param1 - in.Param2
+	default:
+		return out, rpcerr.Errorf(rpcerr.InvalidArgument, "unexpected operation: %s", in.Operation)
 	}
 
-	resp = response.New(http.StatusOK)
-	resp.PutInteger("result", value)
-	return resp, false, nil
+	return out, nil
 }
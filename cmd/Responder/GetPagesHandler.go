@@ -1,20 +1,31 @@
 package main
 
 import (
-	"log/slog"
+	"context"
+	"fmt"
 	"net/http"
 
-	"github.com/rsmaxwell/mqtt-rpc-go/internal/request"
-	"github.com/rsmaxwell/mqtt-rpc-go/internal/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcserver"
 )
 
 type GetPagesHandler struct {
 }
 
-func (h *GetPagesHandler) Handle(req request.Request) (*response.Response, bool, error) {
-	slog.Info("GetPagesHandler")
+// HandleStream sends each page as a message of the stream
+func (h *GetPagesHandler) HandleStream(ctx context.Context, req request.Request, stream rpcserver.Stream) error {
 
-	resp := response.New(http.StatusOK)
-	resp.PutString("result", "[ 'one', 'two', 'three' ]")
-	return resp, false, nil
+	pages := []string{"one", "two", "three"}
+	for i, page := range pages {
+		rpc.ReportProgress(ctx, float64(100*i)/float64(len(pages)), fmt.Sprintf("getting page '%s'", page))
+
+		resp := response.New(http.StatusOK)
+		resp.PutString("page", page)
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -2,18 +2,16 @@ package main
 
 import (
 	"fmt"
-	"log/slog"
 	"net/http"
 
-	"github.com/rsmaxwell/mqtt-rpc-go/internal/request"
-	"github.com/rsmaxwell/mqtt-rpc-go/internal/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
 )
 
 type QuitHandler struct {
 }
 
 func (h *QuitHandler) Handle(req request.Request) (*response.Response, bool, error) {
-	slog.Info("QuitHandler")
 
 	quit, err := req.GetBoolean("quit")
 	if err != nil {
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcauth"
+)
+
+type WhoAmIHandler struct {
+}
+
+// HandleContext returns the principal the request was authenticated as, which is
+// absent when the Responder does not authenticate requests
+func (h *WhoAmIHandler) HandleContext(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+
+	resp := response.New(http.StatusOK)
+	if p, ok := rpcauth.PrincipalFrom(ctx); ok {
+		(*resp)["subject"] = p.Subject
+		if len(p.Roles) > 0 {
+			(*resp)["roles"] = p.Roles
+		}
+	}
+	return resp, false, nil
+}
@@ -21,37 +21,25 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/url"
 	"os"
-	"sync"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/rsmaxwell/mqtt-rpc-go/internal/loggerlevel"
-	"github.com/rsmaxwell/mqtt-rpc-go/internal/request"
-	"github.com/rsmaxwell/mqtt-rpc-go/internal/response"
-)
-
-const qos = 0
-
-type Handler interface {
-	Handle(request.Request) (*response.Response, bool, error)
-}
-
-var (
-	requestHandlers = map[string]Handler{
-		"buildinfo":  new(BuildInfoHandler),
-		"calculator": new(CalculatorHandler),
-		"getPages":   new(GetPagesHandler),
-		"quit":       new(QuitHandler),
-	}
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/tlsconfig"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcauth"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcserver"
 )
 
 func main() {
@@ -62,6 +50,25 @@ func main() {
 	requestTopic := flag.String("rtopic", "request", "Topic for requests to go to")
 	username := flag.String("username", "", "A username to authenticate to the MQTT server")
 	password := flag.String("password", "", "Password to match username")
+	timeout := flag.Duration("timeout", 30*time.Second, "How long a handler may run when the request does not set a message expiry interval (0 means no limit)")
+	workers := flag.Int("workers", runtime.NumCPU(), "The number of requests handled concurrently")
+	queueSize := flag.Int("queue", 64, "The number of requests which may wait for a worker")
+	maxArgsSize := flag.Int("max-args-size", 0, "The largest arguments accepted, in bytes of JSON (0 means no limit)")
+	dedup := flag.Bool("dedup", false, "Answer duplicate requests with the response to the first, rather than handling them again")
+	dedupTTL := flag.Duration("dedup-ttl", 5*time.Minute, "How long responses are kept for duplicate requests")
+	dedupSize := flag.Int("dedup-size", 1000, "The number of responses kept for duplicate requests")
+	batchConcurrency := flag.Int("batch-concurrency", 0, "The number of items of batch requests handled concurrently, across all batches (defaults to -workers)")
+	routingFlag := flag.String("routing", "body", "Receive requests routed by 'body' on the request topic, by 'topic' on <rtopic>/<function>, or 'both'")
+	functions := flag.String("functions", "", "When routing by topic, a comma separated list of the functions to subscribe to (defaults to all)")
+	group := flag.String("group", "", "Share the requests between all the Responders in this group")
+	clientIDPrefix := flag.String("client-id-prefix", "listener", "The prefix of the generated MQTT client ID")
+	qos := flag.Uint("qos", 0, "The quality of service of the subscription to the request topic (0, 1 or 2)")
+	replyQos := flag.Uint("reply-qos", 0, "The quality of service with which replies are published (0, 1 or 2)")
+	jwtKeyFile := flag.String("jwt-key-file", "", "Require requests to carry a bearer token which is a JWT signed (HS256) with the key in this file")
+	tokenFile := flag.String("token-file", "", "Require requests to carry a bearer token listed in this JSON file of tokens and their principals")
+	policyFile := flag.String("policy-file", "", "Only allow the calls which the JSON policy in this file allows, reloading it on SIGHUP")
+	tlsFlags := tlsconfig.AddFlags(flag.CommandLine)
+	grace := flag.Duration("grace", 10*time.Second, "How long requests in progress may take to complete when shutting down")
 	flag.Parse()
 
 	err := loggerlevel.SetLoggerLevel()
@@ -70,23 +77,68 @@ func main() {
 		os.Exit(1)
 	}
 
-	serverUrl, err := url.Parse(*server)
+	if *qos > 2 || *replyQos > 2 {
+		slog.Error(fmt.Sprintf("unexpected qos: %d, reply qos: %d", *qos, *replyQos))
+		os.Exit(1)
+	}
+
+	routing, err := rpc.ParseRouting(*routingFlag)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	var functionList []string
+	if *functions != "" {
+		functionList = strings.Split(*functions, ",")
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	var authenticator rpcauth.Authenticator
+	switch {
+	case *jwtKeyFile != "" && *tokenFile != "":
+		slog.Error("only one of '-jwt-key-file' and '-token-file' may be given")
+		os.Exit(1)
+	case *jwtKeyFile != "":
+		authenticator, err = rpcauth.LoadJWT(*jwtKeyFile)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	case *tokenFile != "":
+		authenticator, err = rpcauth.LoadTokens(*tokenFile)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var policy *rpcauth.PolicyFile
+	if *policyFile != "" {
+		policy, err = rpcauth.NewPolicyFile(*policyFile)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	serverUrl, err := url.Parse(*server)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	tlsConfig, err := tlsFlags.Config()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
 
 	config := autopaho.ClientConfig{
 		ServerUrls:        []*url.URL{serverUrl},
 		KeepAlive:         30,
 		ConnectRetryDelay: 2 * time.Second,
 		ConnectTimeout:    5 * time.Second,
+		TlsCfg:            tlsConfig,
 		OnConnectError:    func(err error) { slog.Info(fmt.Sprintf("error whilst attempting connection: %s\n", err)) },
 		ClientConfig: paho.ClientConfig{
 			OnClientError: func(err error) { slog.Info(fmt.Sprintf("requested disconnect: %s\n", err)) },
@@ -103,70 +155,78 @@ func main() {
 		ConnectPassword: []byte(*password),
 	}
 
-	config.ClientConfig.ClientID = "listener"
-	// Subscribing in OnConnectionUp is the recommended approach because this ensures the subscription is reestablished
-	// following reconnection (the subscription should survive `cliCfg.SessionExpiryInterval` after disconnection,
-	// but in this case that is 0, and it's safer if we don't assume the session survived anyway).
-	config.OnConnectionUp = func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5*time.Second))
-		defer cancel()
-		if _, err := cm.Subscribe(ctx, &paho.Subscribe{
-			Subscriptions: []paho.SubscribeOptions{
-				{Topic: *requestTopic, QoS: qos},
-			},
-		}); err != nil {
-			slog.Info(fmt.Sprintf("listener failed to subscribe (%s). This is likely to mean no messages will be received.", err))
-			return
-		}
+	// Requests are logged with their outcome, including panics which are recovered
+	interceptors := []rpcserver.Interceptor{rpcserver.Logging(), rpcserver.Recover()}
+	if authenticator != nil {
+		interceptors = append(interceptors, rpcauth.Interceptor(authenticator))
+	}
+	if policy != nil {
+		interceptors = append(interceptors, rpcauth.Authorize(policy))
+	}
+	if *maxArgsSize > 0 {
+		interceptors = append(interceptors, rpcserver.MaxArgsSize(*maxArgsSize))
 	}
-	config.OnPublishReceived = []func(paho.PublishReceived) (bool, error){
-		func(received paho.PublishReceived) (bool, error) {
-			if received.Packet.Properties != nil && received.Packet.Properties.CorrelationData != nil && received.Packet.Properties.ResponseTopic != "" {
-				slog.Info(fmt.Sprintf("Received request: %s", string(received.Packet.Payload)))
-
-				var req request.Request
-				if err := json.NewDecoder(bytes.NewReader(received.Packet.Payload)).Decode(&req); err != nil {
-					slog.Info(fmt.Sprintf("discarding request because message could not be decoded: %v", err))
-				}
-
-				handler := requestHandlers[req.Function]
-				if handler == nil {
-					slog.Info(fmt.Sprintf("discarding request because handler not found: %s", req.Function))
-				}
-
-				resp, quit, err := handler.Handle(req)
-				if err != nil {
-					slog.Info("discarding request because handler '%s' failed: %s", req.Function, err)
-				}
 
-				body, _ := json.Marshal(resp)
-				slog.Info(fmt.Sprintf("Sending reply: %s", body))
-
-				_, err = received.Client.Publish(ctx, &paho.Publish{
-					Properties: &paho.PublishProperties{
-						CorrelationData: received.Packet.Properties.CorrelationData,
-					},
-					Topic:   received.Packet.Properties.ResponseTopic,
-					Payload: body,
-				})
-				if err != nil {
-					slog.Error(fmt.Sprintf("failed to publish response: %s", err))
-				}
+	s := rpcserver.New(rpcserver.Options{
+		Config:           config,
+		RequestTopic:     *requestTopic,
+		Routing:          routing,
+		Functions:        functionList,
+		Group:            *group,
+		ClientIDPrefix:   *clientIDPrefix,
+		Timeout:          *timeout,
+		Workers:          *workers,
+		QueueSize:        *queueSize,
+		BatchConcurrency: *batchConcurrency,
+		Interceptors:     interceptors,
+		Dedup:            *dedup,
+		DedupTTL:         *dedupTTL,
+		DedupSize:        *dedupSize,
+		QoS:              byte(*qos),
+		ReplyQoS:         byte(*replyQos),
+		ShutdownTimeout:  *grace,
+	})
+
+	s.Register("buildinfo", new(BuildInfoHandler))
+	rpcserver.Register(s, "calculator", Calculator)
+	s.RegisterStream("getPages", new(GetPagesHandler))
+	s.Register("quit", new(QuitHandler))
+	s.RegisterContext("whoami", new(WhoAmIHandler))
+
+	// Serve until interrupted or asked to quit
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-				if quit {
-					wg.Done()
-				}
-			}
-			return true, nil
-		}}
+	if policy != nil {
+		go reloadOnHangup(ctx, policy)
+	}
 
-	_, err = autopaho.NewConnection(ctx, config)
+	err = s.Serve(ctx)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
-
-	// Wait till asked to quit
-	wg.Wait()
 	slog.Info("Quitting")
 }
+
+// reloadOnHangup reloads the policy each time the process receives SIGHUP, until the
+// context is cancelled
+func reloadOnHangup(ctx context.Context, policy *rpcauth.PolicyFile) {
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := policy.Reload(); err != nil {
+				slog.Error(fmt.Sprintf("keeping the current policy: %s", err))
+				continue
+			}
+			slog.Info("reloaded the policy")
+		}
+	}
+}
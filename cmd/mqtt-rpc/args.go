@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+)
+
+// arg is a typed request argument given on the command line as name[:type]=value
+type arg struct {
+	name  string
+	kind  string
+	value string
+}
+
+func (a arg) put(r *request.Request) error {
+	switch a.kind {
+	case "", "string":
+		r.PutString(a.name, a.value)
+	case "int", "integer":
+		v, err := strconv.ParseInt(a.value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("argument '%s': %w", a.name, err)
+		}
+		r.PutInteger(a.name, v)
+	case "number", "float":
+		v, err := strconv.ParseFloat(a.value, 64)
+		if err != nil {
+			return fmt.Errorf("argument '%s': %w", a.name, err)
+		}
+		r.PutNumber(a.name, v)
+	case "bool", "boolean":
+		v, err := strconv.ParseBool(a.value)
+		if err != nil {
+			return fmt.Errorf("argument '%s': %w", a.name, err)
+		}
+		r.PutBoolean(a.name, v)
+	default:
+		return fmt.Errorf("argument '%s': unknown type '%s'", a.name, a.kind)
+	}
+	return nil
+}
+
+// argList collects the repeated '-arg' flags
+type argList []arg
+
+func (l *argList) String() string {
+	var list []string
+	for _, a := range *l {
+		list = append(list, fmt.Sprintf("%s:%s=%s", a.name, a.kind, a.value))
+	}
+	return strings.Join(list, " ")
+}
+
+func (l *argList) Set(text string) error {
+	name, value, found := strings.Cut(text, "=")
+	if !found {
+		return fmt.Errorf("expected name[:type]=value, got '%s'", text)
+	}
+	name, kind, _ := strings.Cut(name, ":")
+	if name == "" {
+		return fmt.Errorf("missing name in '%s'", text)
+	}
+	*l = append(*l, arg{name: name, kind: kind, value: value})
+	return nil
+}
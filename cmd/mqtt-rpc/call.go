@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/tlsconfig"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcclient"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+)
+
+// call makes a single request and prints the response as JSON, with each message of
+// a streaming response printed as it arrives. It returns the
+// exit status: 1 when the request could not be made, otherwise the class of the
+// response code (4 for 4xx, 5 for 5xx) when the response is not ok
+func call(arguments []string) int {
+
+	var args argList
+
+	flags := flag.NewFlagSet("call", flag.ExitOnError)
+	server := flags.String("server", "mqtt://127.0.0.1:1883", "The URL of the MQTT server")
+	rTopic := flags.String("rtopic", "request", "Topic for requests to go to")
+	username := flags.String("username", "", "A username to authenticate to the MQTT server")
+	password := flags.String("password", "", "Password to match username")
+	bearer := flags.String("token", "", "A bearer token which authenticates the request to the Responder")
+	function := flags.String("function", "", "The function to call")
+	jsonArgs := flags.String("json", "", "The arguments as a JSON object")
+	routingFlag := flags.String("routing", "body", "Publish the request to the request topic with the function in the 'body', or to the 'topic' <rtopic>/<function>")
+	formatFlag := flags.String("format", "native", "The format of the request: 'native', 'jsonrpc' (JSON-RPC 2.0), or the native format encoded as 'cbor' or 'msgpack'")
+	clientIDPrefix := flags.String("client-id-prefix", "requester", "The prefix of the generated MQTT client ID")
+	qos := flags.Uint("qos", 0, "The quality of service with which the request is published (0, 1 or 2)")
+	replyQos := flags.Uint("reply-qos", 0, "The quality of service of the subscription to the response topic (0, 1 or 2)")
+	timeout := flags.Duration("timeout", 0, "How long to wait for the response, which is passed on to the Responder as the request deadline (0 means no limit)")
+	tlsFlags := tlsconfig.AddFlags(flags)
+	flags.Var(&args, "arg", "An argument as name[:type]=value, where type is string, int, number or bool (may be repeated)")
+	flags.Parse(arguments)
+
+	if *function == "" {
+		slog.Error("missing '-function'")
+		return 1
+	}
+
+	if *qos > 2 || *replyQos > 2 {
+		slog.Error(fmt.Sprintf("unexpected qos: %d, reply qos: %d", *qos, *replyQos))
+		return 1
+	}
+
+	routing, err := rpc.ParseRouting(*routingFlag)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	var format rpc.Format
+	switch *formatFlag {
+	case "native":
+		format = rpc.Native
+	case "jsonrpc":
+		format = rpc.JSONRPC
+	case "cbor":
+		format = rpc.CBOR
+	case "msgpack":
+		format = rpc.MessagePack
+	default:
+		slog.Error(fmt.Sprintf("unexpected format: '%s'", *formatFlag))
+		return 1
+	}
+
+	serverUrl, err := url.Parse(*server)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	tlsConfig, err := tlsFlags.Config()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	r := request.New(*function)
+	if *jsonArgs != "" {
+		if err := json.Unmarshal([]byte(*jsonArgs), &r.Args); err != nil {
+			slog.Error(fmt.Sprintf("could not parse '-json': %s", err))
+			return 1
+		}
+		if r.Args == nil {
+			r.Args = make(map[string]interface{})
+		}
+	}
+	for _, a := range args {
+		if err := a.put(r); err != nil {
+			slog.Error(err.Error())
+			return 1
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	config := autopaho.ClientConfig{
+		ServerUrls:        []*url.URL{serverUrl},
+		KeepAlive:         30,
+		ConnectRetryDelay: 2 * time.Second,
+		ConnectTimeout:    5 * time.Second,
+		TlsCfg:            tlsConfig,
+		OnConnectError:    func(err error) { slog.Error(fmt.Sprintf("error whilst attempting connection: %s", err)) },
+		ClientConfig: paho.ClientConfig{
+			OnClientError: func(err error) { slog.Error(fmt.Sprintf("requested disconnect: %s", err)) },
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				if d.Properties != nil {
+					slog.Error(fmt.Sprintf("requested disconnect: %s", d.Properties.ReasonString))
+				} else {
+					slog.Error(fmt.Sprintf("requested disconnect; reason code: %d", d.ReasonCode))
+				}
+			},
+		},
+		ConnectUsername: *username,
+		ConnectPassword: []byte(*password),
+	}
+
+	// Wait for the subscription to be made (otherwise we may miss the response!)
+	connCtx, connCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer connCancel()
+	client, err := rpcclient.Dial(connCtx, rpcclient.Options{
+		Config:         config,
+		RequestTopic:   *rTopic,
+		Routing:        routing,
+		Format:         format,
+		ClientIDPrefix: *clientIDPrefix,
+		QoS:            byte(*qos),
+		ReplyQoS:       byte(*replyQos),
+		Token:          *bearer,
+	})
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+
+	if *timeout > 0 {
+		var timeoutCancel context.CancelFunc
+		ctx, timeoutCancel = context.WithTimeout(ctx, *timeout)
+		defer timeoutCancel()
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	// Each message of a streaming response is printed as it arrives, and the progress
+	// reports of the handler are shown on stderr until then
+	var progress progressLine
+	stream, err := client.CallStream(ctx, r.Function, r.Args, rpcclient.WithProgress(progress.report))
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer stream.Close()
+
+	for {
+		resp, err := stream.Recv()
+		progress.clear()
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			var rpcErr *rpcerr.Error
+			if !errors.As(err, &rpcErr) {
+				slog.Error(err.Error())
+				return 1
+			}
+
+			slog.Error(fmt.Sprintf("error response: code: %d (%s), message: %s", int(rpcErr.Code), rpcErr.Code, rpcErr.Message))
+			if err := encoder.Encode(rpcErr.Response()); err != nil {
+				slog.Error(err.Error())
+				return 1
+			}
+
+			status := 1
+			if class := int(rpcErr.Code) / 100; class > 1 && class < 10 {
+				status = class
+			}
+			return status
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			slog.Error(err.Error())
+			return 1
+		}
+	}
+}
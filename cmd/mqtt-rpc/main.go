@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/loggerlevel"
+)
+
+const usage = `usage: mqtt-rpc <command> [flags]
+
+commands:
+  call    make a request to the Responder and print the response
+  token   print a bearer token signed with the key of the Responder
+
+Run 'mqtt-rpc <command> -h' for the flags of a command.
+`
+
+func main() {
+
+	err := loggerlevel.SetLoggerLevel()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "call":
+		os.Exit(call(os.Args[2:]))
+	case "token":
+		os.Exit(token(os.Args[2:]))
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
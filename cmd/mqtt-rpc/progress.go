@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// progressLine renders the progress reports of a call as a single line on stderr,
+// which is rewritten by each report
+type progressLine struct {
+	mu    sync.Mutex
+	shown bool
+}
+
+func (p *progressLine) report(percent float64, message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "\r[%3.0f%%] %s\033[K", percent, message)
+	p.shown = true
+}
+
+// clear removes the progress line, so that it is not mixed up with the output
+func (p *progressLine) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shown {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.shown = false
+	}
+}
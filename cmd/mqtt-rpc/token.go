@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcauth"
+)
+
+// token prints a bearer token signed with the key which the Responder is given by
+// '-jwt-key-file'. It returns the exit status
+func token(arguments []string) int {
+
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	keyFile := flags.String("jwt-key-file", "", "The file holding the key the token is signed with")
+	subject := flags.String("subject", "", "The principal the token is for")
+	roles := flags.String("roles", "", "A comma separated list of the roles of the principal")
+	ttl := flags.Duration("ttl", time.Hour, "How long the token is valid for (0 means it never expires)")
+	flags.Parse(arguments)
+
+	if *keyFile == "" || *subject == "" {
+		slog.Error("missing '-jwt-key-file' or '-subject'")
+		return 1
+	}
+
+	j, err := rpcauth.LoadJWT(*keyFile)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	p := rpcauth.Principal{Subject: *subject}
+	if *roles != "" {
+		p.Roles = strings.Split(*roles, ",")
+	}
+
+	t, err := j.Issue(p, *ttl)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	fmt.Println(t)
+	return 0
+}
@@ -2,9 +2,16 @@ module github.com/rsmaxwell/mqtt-rpc-go
 
 go 1.22.0
 
-require github.com/eclipse/paho.golang v0.21.0
+require (
+	github.com/eclipse/paho.golang v0.21.0
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.34.2
+)
 
 require (
 	github.com/gorilla/websocket v1.5.1 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/net v0.21.0 // indirect
 )
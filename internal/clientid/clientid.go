@@ -0,0 +1,17 @@
+package clientid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// New returns a client ID made unique by appending random characters to the prefix, so
+// that many instances can connect to the MQTT server at once
+func New(prefix string) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("could not generate client ID: %s", err))
+	}
+	return fmt.Sprintf("%s-%s", prefix, hex.EncodeToString(b))
+}
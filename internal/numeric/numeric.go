@@ -0,0 +1,43 @@
+package numeric
+
+// Int returns the value as an int64 when it holds an integer type. Decoders other
+// than encoding/json give integers their own types rather than float64
+func Int(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// Float returns the value as a float64 when it holds a numeric type
+func Float(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	}
+	if n, ok := Int(value); ok {
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,65 @@
+// Package testbroker connects the integration tests to an MQTT v5 server which
+// supports shared subscriptions, given by MQTT_RPC_TEST_SERVER (defaults to
+// mqtt://127.0.0.1:1883):
+//
+//	go test -tags integration ./pkg/...
+package testbroker
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcserver"
+)
+
+// Config returns the configuration of a connection to the MQTT server
+func Config(t testing.TB) autopaho.ClientConfig {
+	t.Helper()
+
+	server := os.Getenv("MQTT_RPC_TEST_SERVER")
+	if server == "" {
+		server = "mqtt://127.0.0.1:1883"
+	}
+	serverUrl, err := url.Parse(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return autopaho.ClientConfig{
+		ServerUrls:        []*url.URL{serverUrl},
+		KeepAlive:         30,
+		ConnectRetryDelay: time.Second,
+		ConnectTimeout:    5 * time.Second,
+	}
+}
+
+// Serve runs the server until the end of the test, and returns once it has subscribed
+// to its request topics
+func Serve(t testing.TB, s *rpcserver.Server) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var served sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		served.Wait()
+	})
+
+	served.Add(1)
+	go func() {
+		defer served.Done()
+		if err := s.Serve(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case <-s.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatal("the server did not subscribe to its request topics")
+	}
+}
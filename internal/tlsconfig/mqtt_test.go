@@ -0,0 +1,162 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcclient"
+)
+
+// listenMQTT starts an MQTT server over TLS, which requires a client certificate signed
+// by the CA, and sends the common name of each client certificate it accepts. It
+// answers just enough of MQTT v5 for a client to connect and subscribe
+func (p *pki) listenMQTT(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	handshakes := make(chan string, 10)
+	addr := p.serve(t, func(conn *tls.Conn) {
+		if conn.Handshake() != nil {
+			return
+		}
+		handshakes <- conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+
+		for {
+			cp, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			var reply *packets.ControlPacket
+			switch p := cp.Content.(type) {
+			case *packets.Connect:
+				reply = packets.NewControlPacket(packets.CONNACK)
+			case *packets.Subscribe:
+				reply = packets.NewControlPacket(packets.SUBACK)
+				suback := reply.Content.(*packets.Suback)
+				suback.PacketID = p.PacketID
+				suback.Reasons = make([]byte, len(p.Subscriptions))
+			case *packets.Pingreq:
+				reply = packets.NewControlPacket(packets.PINGRESP)
+			case *packets.Disconnect:
+				return
+			default:
+				continue
+			}
+			if _, err := reply.WriteTo(conn); err != nil {
+				return
+			}
+		}
+	})
+	return addr, handshakes
+}
+
+// dial parses the command line arguments as the TLS flags, and connects a client to
+// the MQTT server at mqtts://addr with their configuration. It returns the error of
+// the flags, or of the first attempt to connect
+func dial(t *testing.T, addr string, arguments ...string) error {
+	t.Helper()
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	tlsFlags := AddFlags(flags)
+	if err := flags.Parse(arguments); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := tlsFlags.Config()
+	if err != nil {
+		return err
+	}
+
+	serverUrl, err := url.Parse("mqtts://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client retries until the context is done, so the first failure ends the dial
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	connectErr := make(chan error, 1)
+	config := autopaho.ClientConfig{
+		ServerUrls:        []*url.URL{serverUrl},
+		KeepAlive:         30,
+		ConnectRetryDelay: time.Second,
+		ConnectTimeout:    5 * time.Second,
+		TlsCfg:            tlsConfig,
+		OnConnectError: func(err error) {
+			select {
+			case connectErr <- err:
+				cancel()
+			default:
+			}
+		},
+	}
+
+	client, err := rpcclient.Dial(ctx, rpcclient.Options{Config: config})
+	if err != nil {
+		select {
+		case err = <-connectErr:
+		default:
+		}
+		return err
+	}
+	return client.Disconnect(context.Background())
+}
+
+func TestDialWithClientCertificate(t *testing.T) {
+	p := newPKI(t)
+	addr, handshakes := p.listenMQTT(t)
+
+	if err := dial(t, addr, "-ca-file", p.caFile, "-cert-file", p.certFile, "-key-file", p.keyFile); err != nil {
+		t.Fatalf("expected the client to connect: %s", err)
+	}
+	select {
+	case name := <-handshakes:
+		if name != "client" {
+			t.Fatalf("expected the client certificate, got '%s'", name)
+		}
+	default:
+		t.Fatal("expected the server to complete a handshake")
+	}
+
+	// Without its client certificate, the server rejects the client
+	if err := dial(t, addr, "-ca-file", p.caFile); err == nil {
+		t.Fatal("expected the client without a certificate to be rejected")
+	}
+}
+
+func TestDialUntrustedServer(t *testing.T) {
+	p := newPKI(t)
+	addr, _ := p.listenMQTT(t)
+
+	// Without -ca-file the system pool is used, which does not hold the test CA
+	var unknown x509.UnknownAuthorityError
+	if err := dial(t, addr, "-cert-file", p.certFile, "-key-file", p.keyFile); !errors.As(err, &unknown) {
+		t.Fatalf("expected the server to be unknown without -ca-file, got %v", err)
+	}
+
+	if err := dial(t, addr, "-cert-file", p.certFile, "-key-file", p.keyFile, "-insecure-skip-verify"); err != nil {
+		t.Fatalf("expected the client to connect without verifying the server: %s", err)
+	}
+}
+
+func TestDialCertificateWithoutKey(t *testing.T) {
+	p := newPKI(t)
+	addr, handshakes := p.listenMQTT(t)
+
+	err := dial(t, addr, "-ca-file", p.caFile, "-cert-file", p.certFile)
+	if err == nil || !strings.Contains(err.Error(), "-key-file") {
+		t.Fatalf("expected -cert-file without -key-file to fail, got %v", err)
+	}
+	select {
+	case <-handshakes:
+		t.Fatal("expected no connection to be made")
+	default:
+	}
+}
@@ -0,0 +1,68 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Flags are the command line flags which configure the TLS connection to the MQTT
+// server, for mqtts:// and wss:// URLs
+type Flags struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// AddFlags defines the TLS flags in the flag set
+func AddFlags(flags *flag.FlagSet) *Flags {
+	f := new(Flags)
+	flags.StringVar(&f.CAFile, "ca-file", "", "A PEM file of the certificate authorities trusted to sign the certificate of the MQTT server (defaults to the system pool)")
+	flags.StringVar(&f.CertFile, "cert-file", "", "A PEM file of the client certificate presented to the MQTT server (requires -key-file)")
+	flags.StringVar(&f.KeyFile, "key-file", "", "A PEM file of the private key of the client certificate")
+	flags.BoolVar(&f.InsecureSkipVerify, "insecure-skip-verify", false, "Do not verify the certificate of the MQTT server (for testing only)")
+	return f
+}
+
+// Config returns the TLS configuration given by the flags, or nil when none of them
+// is set, so that the defaults are used
+func (f *Flags) Config() (*tls.Config, error) {
+
+	if f.CAFile == "" && f.CertFile == "" && f.KeyFile == "" && !f.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: f.InsecureSkipVerify,
+	}
+
+	if f.CAFile != "" {
+		pem, err := os.ReadFile(f.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", f.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return nil, errors.New("'-cert-file' and '-key-file' must be given together")
+	}
+	if f.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
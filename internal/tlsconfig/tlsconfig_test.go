@@ -0,0 +1,248 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pki is a certificate authority with a server and a client certificate signed by it,
+// written to PEM files
+type pki struct {
+	caFile     string
+	certFile   string // of the client
+	keyFile    string // of the client
+	server     tls.Certificate
+	clientPool *x509.CertPool
+}
+
+func newPKI(t *testing.T) *pki {
+	t.Helper()
+
+	dir := t.TempDir()
+	p := &pki{
+		caFile:   filepath.Join(dir, "ca.pem"),
+		certFile: filepath.Join(dir, "client.pem"),
+		keyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+
+	caKey := newKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, p.caFile, "CERTIFICATE", caDER)
+	p.clientPool = x509.NewCertPool()
+	p.clientPool.AddCert(ca)
+
+	serverKey := newKey(t)
+	serverDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, &serverKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.server = tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+
+	clientKey := newKey(t)
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, p.certFile, "CERTIFICATE", clientDER)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, p.keyFile, "EC PRIVATE KEY", keyDER)
+
+	return p
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writePEM(t *testing.T, path string, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listen starts a TLS server which requires a client certificate signed by the CA,
+// and writes a byte to each client whose certificate it accepts
+func (p *pki) listen(t *testing.T) string {
+	return p.serve(t, func(conn *tls.Conn) {
+		if conn.Handshake() == nil {
+			conn.Write([]byte{1})
+		}
+	})
+}
+
+// serve starts a TLS server which requires a client certificate signed by the CA, and
+// hands each connection to the handler until the end of the test
+func (p *pki) serve(t *testing.T, handler func(conn *tls.Conn)) string {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{p.server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    p.clientPool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn.(*tls.Conn))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// connect makes a TLS connection with the configuration, and returns the error of the
+// handshake or, since a rejected client certificate is only reported after the
+// handshake with TLS 1.3, of reading from the server
+func connect(addr string, config *tls.Config) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, make([]byte, 1))
+	return err
+}
+
+func TestMutualTLS(t *testing.T) {
+	p := newPKI(t)
+	addr := p.listen(t)
+
+	config, err := (&Flags{CAFile: p.caFile, CertFile: p.certFile, KeyFile: p.keyFile}).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(addr, config); err != nil {
+		t.Fatalf("expected the handshake to succeed: %s", err)
+	}
+
+	// Without its client certificate, the server rejects the client
+	config, err = (&Flags{CAFile: p.caFile}).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(addr, config); err == nil {
+		t.Fatal("expected the handshake without a client certificate to fail")
+	}
+}
+
+func TestUntrustedServer(t *testing.T) {
+	p := newPKI(t)
+	addr := p.listen(t)
+
+	// Without -ca-file the system pool is used, which does not hold the test CA
+	config, err := (&Flags{CertFile: p.certFile, KeyFile: p.keyFile}).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unknown x509.UnknownAuthorityError
+	if err := connect(addr, config); !errors.As(err, &unknown) {
+		t.Fatalf("expected the server to be unknown without -ca-file, got %v", err)
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	p := newPKI(t)
+	addr := p.listen(t)
+
+	config, err := (&Flags{CertFile: p.certFile, KeyFile: p.keyFile, InsecureSkipVerify: true}).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(addr, config); err != nil {
+		t.Fatalf("expected the handshake to succeed without verifying the server: %s", err)
+	}
+}
+
+func TestNoFlags(t *testing.T) {
+	config, err := (&Flags{}).Config()
+	if err != nil || config != nil {
+		t.Fatalf("expected no configuration when no flag is set, got %v, %v", config, err)
+	}
+}
+
+func TestInvalidFlags(t *testing.T) {
+	p := newPKI(t)
+
+	tests := []struct {
+		name  string
+		flags Flags
+	}{
+		{"cert without key", Flags{CAFile: p.caFile, CertFile: p.certFile}},
+		{"key without cert", Flags{CAFile: p.caFile, KeyFile: p.keyFile}},
+		{"key is not a key", Flags{CertFile: p.certFile, KeyFile: p.caFile}},
+		{"missing CA file", Flags{CAFile: filepath.Join(t.TempDir(), "missing.pem")}},
+		{"CA file without certificates", Flags{CAFile: p.keyFile}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.flags.Config(); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
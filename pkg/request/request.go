@@ -2,6 +2,8 @@ package request
 
 import (
 	"fmt"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/numeric"
 )
 
 type Request struct {
@@ -34,6 +36,9 @@ func (r Request) PutInteger(key string, value int64) {
 }
 
 func (r Request) GetInteger(key string) (int64, error) {
+	if n, ok := numeric.Int(r.Args[key]); ok {
+		return n, nil
+	}
 	v, err := r.GetNumber(key)
 	return int64(v), err
 }
@@ -44,7 +49,7 @@ func (r Request) PutNumber(key string, value float64) {
 
 func (r Request) GetNumber(key string) (float64, error) {
 	value := r.Args[key]
-	v, ok := value.(float64)
+	v, ok := numeric.Float(value)
 	if !ok {
 		return 0, fmt.Errorf("unexpected type for '%s': %+v", key, value)
 	}
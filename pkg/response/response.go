@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/rsmaxwell/mqtt-rpc-go/internal/buildinfo"
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/numeric"
 )
 
 type Response map[string]interface{}
@@ -48,6 +49,19 @@ func (r *Response) GetMessage() (string, error) {
 	return s, nil
 }
 
+func (r *Response) PutDetails(details []interface{}) {
+	(*r)["details"] = details
+}
+
+func (r *Response) GetDetails() ([]interface{}, error) {
+	value := (*r)["details"]
+	v, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected type for 'details': %+v", value)
+	}
+	return v, nil
+}
+
 func (r *Response) PutBuildInfo(value *buildinfo.BuildInfo) {
 	(*r)["version"] = value.Version
 	(*r)["buildDate"] = value.BuildDate
@@ -116,6 +130,9 @@ func (r *Response) PutInteger(key string, value int64) {
 }
 
 func (r *Response) GetInteger(key string) (int64, error) {
+	if n, ok := numeric.Int((*r)[key]); ok {
+		return n, nil
+	}
 	n, err := r.GetNumber(key)
 	if err != nil {
 		return 0, err
@@ -129,7 +146,7 @@ func (r *Response) PutNumber(key string, value float64) {
 
 func (r *Response) GetNumber(key string) (float64, error) {
 	value := (*r)[key]
-	v, ok := value.(float64)
+	v, ok := numeric.Float(value)
 	if !ok {
 		return 0, fmt.Errorf("unexpected type for '%s': %+v", key, value)
 	}
@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec marshals values to and from the bytes of a payload. Struct fields are named
+// by their json tags whatever the codec, so that the request and response types
+// encode the same way in every codec
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+
+	// IsArray reports whether the data holds an array
+	IsArray(data []byte) bool
+}
+
+var (
+	// JSONCodec encodes values as JSON, which decodes every number as a float64
+	JSONCodec Codec = jsonCodec{}
+
+	// CBORCodec encodes values as CBOR (RFC 8949)
+	CBORCodec Codec = newCBORCodec()
+
+	// MessagePackCodec encodes values as MessagePack
+	MessagePackCodec Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (jsonCodec) IsArray(data []byte) bool {
+	return isJSONArray(data)
+}
+
+func isJSONArray(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '['
+}
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+	enc, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+
+	// Decode maps in the way encoding/json does, so that nested objects can be read
+	// with the same type assertions whatever the codec
+	dec, err := cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (cborCodec) ContentType() string {
+	return "application/cbor"
+}
+
+func (c cborCodec) Marshal(v any) ([]byte, error) {
+	return c.enc.Marshal(v)
+}
+
+func (c cborCodec) Unmarshal(data []byte, v any) error {
+	return c.dec.Unmarshal(data, v)
+}
+
+// IsArray checks for the CBOR major type 4, which is an array
+func (cborCodec) IsArray(data []byte) bool {
+	return len(data) > 0 && data[0]>>5 == 4
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	dec.UseLooseInterfaceDecoding(true)
+	return dec.Decode(v)
+}
+
+// IsArray checks for a MessagePack fixarray, array 16 or array 32
+func (msgpackCodec) IsArray(data []byte) bool {
+	return len(data) > 0 && (data[0]&0xf0 == 0x90 || data[0] == 0xdc || data[0] == 0xdd)
+}
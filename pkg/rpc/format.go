@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+)
+
+// Format converts requests and responses to and from the payload of a message. The
+// format of a message is given by its MQTT v5 ContentType property. The id is the
+// identifier some formats carry from a request to its response; it is not used to
+// correlate them, which is done with the MQTT v5 CorrelationData property.
+type Format interface {
+	ContentType() string
+	EncodeRequest(req *request.Request, id any) ([]byte, error)
+	DecodeRequest(payload []byte) (req *request.Request, id any, err error)
+	EncodeResponse(resp *response.Response, id any) ([]byte, error)
+	DecodeResponse(payload []byte) (*response.Response, error)
+}
+
+// BatchFormat is a Format which can also carry a batch of requests in one message,
+// answered by a batch of responses in the same order
+type BatchFormat interface {
+	Format
+	IsBatch(payload []byte) bool
+	EncodeBatchRequest(reqs []*request.Request, ids []any) ([]byte, error)
+	DecodeBatchRequest(payload []byte) (reqs []*request.Request, ids []any, err error)
+	EncodeBatchResponse(resps []*response.Response, ids []any) ([]byte, error)
+	DecodeBatchResponse(payload []byte) ([]*response.Response, error)
+}
+
+// DecodeErrorFormat is a Format which replies to a request that could not be decoded
+// in its own way, given the error returned by DecodeRequest
+type DecodeErrorFormat interface {
+	Format
+	EncodeDecodeError(resp *response.Response, err error, id any) ([]byte, error)
+}
+
+// Notification is the id returned by DecodeRequest for a request which must not be
+// answered, such as a JSON-RPC request without an id
+type Notification struct{}
+
+var (
+	// Native is the {function, args} and {code, message, ...} format of the request
+	// and response packages, encoded as JSON
+	Native Format = NativeFormat(JSONCodec)
+
+	// CBOR is the Native format encoded as CBOR
+	CBOR Format = NativeFormat(CBORCodec)
+
+	// MessagePack is the Native format encoded as MessagePack
+	MessagePack Format = NativeFormat(MessagePackCodec)
+
+	// JSONRPC is the JSON-RPC 2.0 format
+	JSONRPC Format = jsonrpcFormat{}
+
+	// Protobuf carries the serialized protobuf messages of typed handlers, under
+	// ProtobufKey, in a protobuf envelope
+	Protobuf Format = protobufFormat{}
+)
+
+var (
+	formatsMutex sync.RWMutex
+	formats      = map[string]Format{
+		Native.ContentType():      Native,
+		CBOR.ContentType():        CBOR,
+		MessagePack.ContentType(): MessagePack,
+		JSONRPC.ContentType():     JSONRPC,
+		Protobuf.ContentType():    Protobuf,
+	}
+)
+
+// RegisterFormat adds a format, replacing any existing format with the same content type
+func RegisterFormat(f Format) {
+	formatsMutex.Lock()
+	defer formatsMutex.Unlock()
+	formats[strings.ToLower(f.ContentType())] = f
+}
+
+// FormatFor returns the format for the content type. A message with no content type
+// is in the Native format
+func FormatFor(contentType string) (Format, error) {
+	if contentType == "" {
+		return Native, nil
+	}
+
+	// Ignore any parameters, such as "; charset=utf-8"
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	formatsMutex.RLock()
+	defer formatsMutex.RUnlock()
+	f, ok := formats[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content type: '%s'", contentType)
+	}
+	return f, nil
+}
+
+// NativeFormat returns the Native format encoded with the codec, whose content type
+// is that of the codec
+func NativeFormat(codec Codec) Format {
+	return nativeFormat{codec: codec}
+}
+
+type nativeFormat struct {
+	codec Codec
+}
+
+func (f nativeFormat) ContentType() string {
+	return f.codec.ContentType()
+}
+
+func (f nativeFormat) EncodeRequest(req *request.Request, id any) ([]byte, error) {
+	return f.codec.Marshal(req)
+}
+
+func (f nativeFormat) DecodeRequest(payload []byte) (*request.Request, any, error) {
+	var req request.Request
+	if err := f.codec.Unmarshal(payload, &req); err != nil {
+		return nil, nil, err
+	}
+	return &req, nil, nil
+}
+
+func (f nativeFormat) EncodeResponse(resp *response.Response, id any) ([]byte, error) {
+	return f.codec.Marshal(resp)
+}
+
+func (f nativeFormat) DecodeResponse(payload []byte) (*response.Response, error) {
+	var resp response.Response
+	if err := f.codec.Unmarshal(payload, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// IsBatch reports whether the payload is an array, which is a batch
+func (f nativeFormat) IsBatch(payload []byte) bool {
+	return f.codec.IsArray(payload)
+}
+
+func (f nativeFormat) EncodeBatchRequest(reqs []*request.Request, ids []any) ([]byte, error) {
+	return f.codec.Marshal(reqs)
+}
+
+func (f nativeFormat) DecodeBatchRequest(payload []byte) ([]*request.Request, []any, error) {
+	var reqs []*request.Request
+	if err := f.codec.Unmarshal(payload, &reqs); err != nil {
+		return nil, nil, err
+	}
+	for i, req := range reqs {
+		if req == nil {
+			return nil, nil, fmt.Errorf("batch item %d is null", i)
+		}
+	}
+	return reqs, make([]any, len(reqs)), nil
+}
+
+func (f nativeFormat) EncodeBatchResponse(resps []*response.Response, ids []any) ([]byte, error) {
+	return f.codec.Marshal(resps)
+}
+
+func (f nativeFormat) DecodeBatchResponse(payload []byte) ([]*response.Response, error) {
+	var resps []*response.Response
+	if err := f.codec.Unmarshal(payload, &resps); err != nil {
+		return nil, err
+	}
+	return resps, nil
+}
@@ -0,0 +1,318 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcInternalError  = -32603
+	jsonrpcServerError    = -32000
+)
+
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"` // nil for a notification
+}
+
+// jsonrpcDecodeError is a request which could not be decoded, with the JSON-RPC code
+// of the problem
+type jsonrpcDecodeError struct {
+	code int
+	err  error
+}
+
+func (e *jsonrpcDecodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *jsonrpcDecodeError) Unwrap() error {
+	return e.err
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *jsonrpcError   `json:"error"`
+	ID      any             `json:"id"`
+}
+
+type jsonrpcError struct {
+	Code    int          `json:"code"`
+	Message string       `json:"message"`
+	Data    *jsonrpcData `json:"data,omitempty"`
+}
+
+// jsonrpcData carries the code of the response, which the JSON-RPC error codes
+// cannot always represent, and its details
+type jsonrpcData struct {
+	Code    int           `json:"code"`
+	Details []interface{} `json:"details,omitempty"`
+}
+
+// jsonrpcFormat maps the function and args of a request onto the method and params
+// of a JSON-RPC request, which must be passed by name. An ok response becomes the
+// result, holding every field but the code, and any other response becomes the error
+type jsonrpcFormat struct{}
+
+func (jsonrpcFormat) ContentType() string {
+	return "application/json-rpc"
+}
+
+func (jsonrpcFormat) EncodeRequest(req *request.Request, id any) ([]byte, error) {
+	params, err := json.Marshal(req.Args)
+	if err != nil {
+		return nil, err
+	}
+	r := jsonrpcRequest{JSONRPC: "2.0", Method: req.Function, Params: params}
+	if id != nil {
+		if r.ID, err = json.Marshal(id); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(r)
+}
+
+// DecodeRequest returns the id Notification for a request without an id. Its errors
+// carry the JSON-RPC code of the problem, which EncodeDecodeError replies with
+func (jsonrpcFormat) DecodeRequest(payload []byte) (*request.Request, any, error) {
+
+	if !json.Valid(payload) {
+		return nil, nil, &jsonrpcDecodeError{jsonrpcParseError, errors.New("invalid JSON")}
+	}
+
+	var r jsonrpcRequest
+	if err := json.Unmarshal(payload, &r); err != nil {
+		return nil, nil, &jsonrpcDecodeError{jsonrpcInvalidRequest, err}
+	}
+
+	var id any = Notification{}
+	if r.ID != nil {
+		if err := json.Unmarshal(r.ID, &id); err != nil {
+			return nil, nil, &jsonrpcDecodeError{jsonrpcInvalidRequest, err}
+		}
+	}
+
+	// The id of an invalid request cannot be relied on, so it is replied to even when
+	// it appears to be a notification
+	if r.JSONRPC != "2.0" {
+		return nil, nil, &jsonrpcDecodeError{jsonrpcInvalidRequest, fmt.Errorf("unexpected jsonrpc version: '%s'", r.JSONRPC)}
+	}
+	if r.Method == "" {
+		return nil, nil, &jsonrpcDecodeError{jsonrpcInvalidRequest, errors.New("missing method")}
+	}
+
+	req := request.New(r.Method)
+	if len(r.Params) > 0 && !bytes.Equal(r.Params, []byte("null")) {
+		if err := json.Unmarshal(r.Params, &req.Args); err != nil {
+			return nil, id, &jsonrpcDecodeError{jsonrpcInvalidParams, fmt.Errorf("params must be an object: %w", err)}
+		}
+	}
+	return req, id, nil
+}
+
+// EncodeDecodeError replies to a request which could not be decoded with the JSON-RPC
+// code of the problem
+func (jsonrpcFormat) EncodeDecodeError(resp *response.Response, err error, id any) ([]byte, error) {
+
+	var decodeError *jsonrpcDecodeError
+	if !errors.As(err, &decodeError) {
+		return jsonrpcFormat{}.EncodeResponse(resp, id)
+	}
+
+	resp, err = normalize(resp)
+	if err != nil {
+		return nil, err
+	}
+	return encodeJSONRPCError(resp, id, decodeError.code)
+}
+
+func (jsonrpcFormat) EncodeResponse(resp *response.Response, id any) ([]byte, error) {
+
+	resp, err := normalize(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Ok() {
+		result := make(map[string]interface{})
+		for key, value := range *resp {
+			if key != "code" {
+				result[key] = value
+			}
+		}
+		return json.Marshal(map[string]any{"jsonrpc": "2.0", "result": result, "id": id})
+	}
+
+	code, _ := resp.GetCode()
+	return encodeJSONRPCError(resp, id, jsonrpcCode(code))
+}
+
+// encodeJSONRPCError encodes the normalized response as an error with the JSON-RPC code
+func encodeJSONRPCError(resp *response.Response, id any, jsonrpcCode int) ([]byte, error) {
+
+	code, _ := resp.GetCode()
+	message, _ := resp.GetMessage()
+	details, _ := resp.GetDetails()
+
+	e := jsonrpcError{
+		Code:    jsonrpcCode,
+		Message: message,
+		Data:    &jsonrpcData{Code: code, Details: details},
+	}
+	return json.Marshal(map[string]any{"jsonrpc": "2.0", "error": e, "id": id})
+}
+
+func (jsonrpcFormat) DecodeResponse(payload []byte) (*response.Response, error) {
+
+	var r jsonrpcResponse
+	if err := json.NewDecoder(bytes.NewReader(payload)).Decode(&r); err != nil {
+		return nil, err
+	}
+
+	if r.Error != nil {
+		code := responseCode(r.Error.Code)
+		if r.Error.Data != nil && r.Error.Data.Code != 0 {
+			code = r.Error.Data.Code
+		}
+		resp := response.New(code)
+		resp.PutMessage(r.Error.Message)
+		if r.Error.Data != nil && len(r.Error.Data.Details) > 0 {
+			resp.PutDetails(r.Error.Data.Details)
+		}
+		return normalize(resp)
+	}
+
+	var result interface{}
+	if err := json.Unmarshal(r.Result, &result); err != nil {
+		return nil, fmt.Errorf("could not decode result: %w", err)
+	}
+
+	resp := response.New(http.StatusOK)
+	if fields, ok := result.(map[string]interface{}); ok {
+		for key, value := range fields {
+			(*resp)[key] = value
+		}
+		resp.PutCode(http.StatusOK)
+	} else if result != nil {
+		(*resp)["result"] = result
+	}
+	return normalize(resp)
+}
+
+// normalize gives the fields of the response the types they have once decoded from
+// JSON, which are the types the getters of the response expect
+func normalize(resp *response.Response) (*response.Response, error) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	var r response.Response
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func jsonrpcCode(code int) int {
+	switch code {
+	case http.StatusBadRequest:
+		return jsonrpcInvalidParams
+	case http.StatusNotFound:
+		return jsonrpcMethodNotFound
+	case http.StatusInternalServerError:
+		return jsonrpcInternalError
+	}
+	return jsonrpcServerError
+}
+
+func responseCode(code int) int {
+	switch code {
+	case jsonrpcParseError, jsonrpcInvalidRequest, jsonrpcInvalidParams:
+		return http.StatusBadRequest
+	case jsonrpcMethodNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// IsBatch reports whether the payload is a JSON-RPC batch, which is an array
+func (jsonrpcFormat) IsBatch(payload []byte) bool {
+	return isJSONArray(payload)
+}
+
+func (f jsonrpcFormat) EncodeBatchRequest(reqs []*request.Request, ids []any) ([]byte, error) {
+	items := make([]json.RawMessage, len(reqs))
+	for i, req := range reqs {
+		item, err := f.EncodeRequest(req, ids[i])
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return json.Marshal(items)
+}
+
+func (f jsonrpcFormat) DecodeBatchRequest(payload []byte) ([]*request.Request, []any, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(payload, &items); err != nil {
+		return nil, nil, &jsonrpcDecodeError{jsonrpcParseError, err}
+	}
+	if len(items) == 0 {
+		return nil, nil, &jsonrpcDecodeError{jsonrpcInvalidRequest, errors.New("empty batch")}
+	}
+
+	reqs := make([]*request.Request, len(items))
+	ids := make([]any, len(items))
+	for i, item := range items {
+		req, id, err := f.DecodeRequest(item)
+		if err != nil {
+			return nil, nil, fmt.Errorf("batch item %d: %w", i, err)
+		}
+		reqs[i] = req
+		ids[i] = id
+	}
+	return reqs, ids, nil
+}
+
+func (f jsonrpcFormat) EncodeBatchResponse(resps []*response.Response, ids []any) ([]byte, error) {
+	items := make([]json.RawMessage, len(resps))
+	for i, resp := range resps {
+		item, err := f.EncodeResponse(resp, ids[i])
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return json.Marshal(items)
+}
+
+func (f jsonrpcFormat) DecodeBatchResponse(payload []byte) ([]*response.Response, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(payload, &items); err != nil {
+		return nil, err
+	}
+
+	resps := make([]*response.Response, len(items))
+	for i, item := range items {
+		resp, err := f.DecodeResponse(item)
+		if err != nil {
+			return nil, fmt.Errorf("batch item %d: %w", i, err)
+		}
+		resps[i] = resp
+	}
+	return resps, nil
+}
@@ -0,0 +1,75 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+)
+
+func TestJSONRPCDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		code    int
+		id      any
+	}{
+		{"malformed", `{"jsonrpc": "2.0", "method": `, jsonrpcParseError, nil},
+		{"not an object", `5`, jsonrpcInvalidRequest, nil},
+		{"wrong version", `{"jsonrpc": "1.0", "method": "add", "id": 1}`, jsonrpcInvalidRequest, nil},
+		{"missing method", `{"jsonrpc": "2.0", "id": 1}`, jsonrpcInvalidRequest, nil},
+		{"method is not a string", `{"jsonrpc": "2.0", "method": 1, "id": 1}`, jsonrpcInvalidRequest, nil},
+		{"positional params", `{"jsonrpc": "2.0", "method": "add", "params": [1, 2], "id": 1}`, jsonrpcInvalidParams, float64(1)},
+	}
+
+	format := JSONRPC.(DecodeErrorFormat)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, id, err := format.DecodeRequest([]byte(test.payload))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if id != test.id {
+				t.Fatalf("expected id %v, got %v", test.id, id)
+			}
+
+			body, err := format.EncodeDecodeError(response.New(http.StatusBadRequest), err, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reply jsonrpcResponse
+			if err := json.Unmarshal(body, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Error == nil || reply.Error.Code != test.code {
+				t.Fatalf("expected error code %d, got %s", test.code, body)
+			}
+		})
+	}
+}
+
+func TestJSONRPCNotification(t *testing.T) {
+	req, id, err := JSONRPC.DecodeRequest([]byte(`{"jsonrpc": "2.0", "method": "log", "params": {"line": "x"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := id.(Notification); !ok || req.Function != "log" {
+		t.Fatalf("expected a notification of 'log', got %v with id %v", req, id)
+	}
+
+	// A null id is an id, not a notification
+	if _, id, err = JSONRPC.DecodeRequest([]byte(`{"jsonrpc": "2.0", "method": "log", "id": null}`)); err != nil || id != nil {
+		t.Fatalf("expected a null id, got %v (%v)", id, err)
+	}
+
+	// Requests encoded without an id are notifications
+	payload, err := JSONRPC.EncodeRequest(request.New("log"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, id, err := JSONRPC.DecodeRequest(payload); err != nil || id != (Notification{}) {
+		t.Fatalf("expected a notification, got %s", payload)
+	}
+}
@@ -0,0 +1,49 @@
+package rpc
+
+import (
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// User properties of the messages of a call, other than requests and single replies
+const (
+	// KindProperty says what a message is
+	KindProperty = "kind"
+
+	// SeqProperty is the sequence number of a message of a stream, counting from 0
+	SeqProperty = "seq"
+
+	// IdempotencyKeyProperty identifies a request and its duplicates, which are answered
+	// with the response to the first rather than being handled again
+	IdempotencyKeyProperty = "idempotency-key"
+
+	// AuthorizationProperty carries the credentials of a request, as "Bearer <token>"
+	AuthorizationProperty = "authorization"
+)
+
+// Kinds of message
+const (
+	// KindData is a message of a stream, holding an ok response
+	KindData = "data"
+
+	// KindEnd ends a stream, holding its status: an ok response, or the error which
+	// ended the stream
+	KindEnd = "end"
+
+	// KindCancel asks the Responder to stop handling the request with the same response
+	// topic and correlation data, whose reply is no longer wanted. It is published to
+	// the CancelTopic of the request topic, with the authorization of the request, and
+	// has no payload
+	KindCancel = "cancel"
+
+	// KindProgress reports the progress of a request, holding an ok response with its
+	// "percent" and "message"
+	KindProgress = "progress"
+)
+
+// Kind returns the kind of the message, which is empty for requests and single replies
+func Kind(props *paho.PublishProperties) string {
+	if props == nil {
+		return ""
+	}
+	return props.User.Get(KindProperty)
+}
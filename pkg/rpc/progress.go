@@ -0,0 +1,23 @@
+package rpc
+
+import (
+	"context"
+)
+
+type progressKey struct{}
+
+// WithProgress returns a context in which ReportProgress calls report
+func WithProgress(ctx context.Context, report func(percent float64, message string) error) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+// ReportProgress tells the caller of the request being handled in the context how far
+// it has got. It does nothing when the context has no way to report progress, as in
+// the items of a batch
+func ReportProgress(ctx context.Context, percent float64, message string) error {
+	report, ok := ctx.Value(progressKey{}).(func(percent float64, message string) error)
+	if !ok {
+		return nil
+	}
+	return report(percent, message)
+}
@@ -0,0 +1,244 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProtobufKey is the argument of a request, and the field of a response, which holds
+// a serialized protobuf message in the Protobuf format
+const ProtobufKey = "$protobuf"
+
+// Fields of the protobuf envelopes of requests and responses
+const (
+	pbRequestFunction protowire.Number = 1
+	pbRequestMessage  protowire.Number = 2 // bytes: the serialized message of a typed handler
+	pbRequestArgs     protowire.Number = 3 // bytes: any other args, as a JSON object
+
+	pbResponseCode    protowire.Number = 1
+	pbResponseMessage protowire.Number = 2
+	pbResponseResult  protowire.Number = 3 // bytes: the serialized message of a typed handler
+	pbResponseDetail  protowire.Number = 4 // repeated bytes: each detail as JSON
+	pbResponseFields  protowire.Number = 5 // bytes: any other fields, as a JSON object
+)
+
+// protobufFormat wraps the serialized messages of typed handlers, which are held
+// under ProtobufKey, in a protobuf envelope carrying the function of a request and
+// the code of a response:
+//
+//	message Request { string function = 1; bytes message = 2; bytes args = 3; }
+//	message Response { int32 code = 1; string message = 2; bytes result = 3; repeated bytes details = 4; bytes fields = 5; }
+//
+// Args and fields which are not protobuf messages are carried as JSON, so that any
+// function can be called in this format. It has no ids, and does not support batches
+type protobufFormat struct{}
+
+func (protobufFormat) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protobufFormat) EncodeRequest(req *request.Request, id any) ([]byte, error) {
+
+	var b []byte
+	b = protowire.AppendTag(b, pbRequestFunction, protowire.BytesType)
+	b = protowire.AppendString(b, req.Function)
+
+	args := make(map[string]interface{})
+	for key, value := range req.Args {
+		if key != ProtobufKey {
+			args[key] = value
+			continue
+		}
+		message, ok := value.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("'%s' must hold a serialized message", ProtobufKey)
+		}
+		b = protowire.AppendTag(b, pbRequestMessage, protowire.BytesType)
+		b = protowire.AppendBytes(b, message)
+	}
+
+	if len(args) > 0 {
+		j, err := json.Marshal(args)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, pbRequestArgs, protowire.BytesType)
+		b = protowire.AppendBytes(b, j)
+	}
+	return b, nil
+}
+
+func (protobufFormat) DecodeRequest(payload []byte) (*request.Request, any, error) {
+
+	req := request.New("")
+	err := consumeFields(payload, func(num protowire.Number, value []byte) error {
+		switch num {
+		case pbRequestFunction:
+			req.Function = string(value)
+		case pbRequestMessage:
+			req.Args[ProtobufKey] = value
+		case pbRequestArgs:
+			var args map[string]interface{}
+			if err := json.Unmarshal(value, &args); err != nil {
+				return fmt.Errorf("args must be a JSON object: %w", err)
+			}
+			for key, arg := range args {
+				req.Args[key] = arg
+			}
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.Function == "" {
+		return nil, nil, errors.New("missing function")
+	}
+	return req, nil, nil
+}
+
+func (protobufFormat) EncodeResponse(resp *response.Response, id any) ([]byte, error) {
+
+	code, err := resp.GetCode()
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, pbResponseCode, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(int64(code)))
+
+	fields := make(map[string]interface{})
+	for key, value := range *resp {
+		switch key {
+		case "code":
+		case "message":
+			message, ok := value.(string)
+			if !ok {
+				return nil, errors.New("message must be a string")
+			}
+			b = protowire.AppendTag(b, pbResponseMessage, protowire.BytesType)
+			b = protowire.AppendString(b, message)
+		case "details":
+			details, ok := value.([]interface{})
+			if !ok {
+				return nil, errors.New("details must be a list")
+			}
+			for _, detail := range details {
+				j, err := json.Marshal(detail)
+				if err != nil {
+					return nil, err
+				}
+				b = protowire.AppendTag(b, pbResponseDetail, protowire.BytesType)
+				b = protowire.AppendBytes(b, j)
+			}
+		case ProtobufKey:
+			result, ok := value.([]byte)
+			if !ok {
+				return nil, fmt.Errorf("'%s' must hold a serialized message", ProtobufKey)
+			}
+			b = protowire.AppendTag(b, pbResponseResult, protowire.BytesType)
+			b = protowire.AppendBytes(b, result)
+		default:
+			fields[key] = value
+		}
+	}
+
+	if len(fields) > 0 {
+		j, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, pbResponseFields, protowire.BytesType)
+		b = protowire.AppendBytes(b, j)
+	}
+	return b, nil
+}
+
+func (protobufFormat) DecodeResponse(payload []byte) (*response.Response, error) {
+
+	resp := response.Response{}
+	var details []interface{}
+	err := consumeFields(payload, func(num protowire.Number, value []byte) error {
+		switch num {
+		case pbResponseMessage:
+			resp["message"] = string(value)
+		case pbResponseResult:
+			resp[ProtobufKey] = value
+		case pbResponseDetail:
+			var detail interface{}
+			if err := json.Unmarshal(value, &detail); err != nil {
+				return fmt.Errorf("could not decode detail: %w", err)
+			}
+			details = append(details, detail)
+		case pbResponseFields:
+			var fields map[string]interface{}
+			if err := json.Unmarshal(value, &fields); err != nil {
+				return fmt.Errorf("fields must be a JSON object: %w", err)
+			}
+			for key, field := range fields {
+				resp[key] = field
+			}
+		}
+		return nil
+	}, func(num protowire.Number, value uint64) {
+		if num == pbResponseCode {
+			resp["code"] = int64(value)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := resp["code"]; !ok {
+		return nil, errors.New("missing code")
+	}
+	if details != nil {
+		resp["details"] = details
+	}
+	return &resp, nil
+}
+
+// consumeFields calls bytesField for each length delimited field of the message, and
+// varintField, unless nil, for each varint field. Other fields are skipped
+func consumeFields(b []byte, bytesField func(protowire.Number, []byte) error, varintField func(protowire.Number, uint64)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch typ {
+		case protowire.BytesType:
+			value, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := bytesField(num, value); err != nil {
+				return err
+			}
+			b = b[n:]
+		case protowire.VarintType:
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if varintField != nil {
+				varintField(num, value)
+			}
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package rpc
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+)
+
+func TestProtobufRequest(t *testing.T) {
+	req := request.New("convert")
+	req.Args[ProtobufKey] = []byte{0x0a, 0x01, 'x'}
+	req.Args["verbose"] = true
+
+	payload, err := Protobuf.EncodeRequest(req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := Protobuf.DecodeRequest(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Function != "convert" {
+		t.Errorf("expected function 'convert', got '%s'", decoded.Function)
+	}
+	if message, _ := decoded.Args[ProtobufKey].([]byte); !bytes.Equal(message, []byte{0x0a, 0x01, 'x'}) {
+		t.Errorf("unexpected message: %v", decoded.Args[ProtobufKey])
+	}
+	if verbose, err := decoded.GetBoolean("verbose"); err != nil || !verbose {
+		t.Errorf("expected verbose to be true: %v", err)
+	}
+}
+
+func TestProtobufResponse(t *testing.T) {
+	resp := response.New(http.StatusOK)
+	(*resp)[ProtobufKey] = []byte{0x08, 0x2a}
+	(*resp)["count"] = 3
+
+	payload, err := Protobuf.EncodeResponse(resp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Protobuf.DecodeResponse(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code, err := decoded.GetCode(); err != nil || code != http.StatusOK {
+		t.Errorf("expected code 200, got %d (%v)", code, err)
+	}
+	if result, _ := (*decoded)[ProtobufKey].([]byte); !bytes.Equal(result, []byte{0x08, 0x2a}) {
+		t.Errorf("unexpected result: %v", (*decoded)[ProtobufKey])
+	}
+	if count, err := decoded.GetInteger("count"); err != nil || count != 3 {
+		t.Errorf("expected count 3, got %d (%v)", count, err)
+	}
+}
+
+func TestProtobufErrorResponse(t *testing.T) {
+	resp := response.New(http.StatusBadRequest)
+	resp.PutMessage("invalid arguments")
+	resp.PutDetails([]interface{}{"missing 'name'"})
+
+	payload, err := Protobuf.EncodeResponse(resp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Protobuf.DecodeResponse(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := decoded.GetCode(); code != http.StatusBadRequest {
+		t.Errorf("expected code 400, got %d", code)
+	}
+	if message, _ := decoded.GetMessage(); message != "invalid arguments" {
+		t.Errorf("unexpected message: '%s'", message)
+	}
+	if details, _ := decoded.GetDetails(); len(details) != 1 || details[0] != "missing 'name'" {
+		t.Errorf("unexpected details: %v", details)
+	}
+}
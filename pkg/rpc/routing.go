@@ -0,0 +1,56 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Routing says how requests are routed to functions
+type Routing int
+
+const (
+	// RouteByBody publishes requests to the request topic, with the function named in the body
+	RouteByBody Routing = 1 << iota
+
+	// RouteByTopic publishes requests to the topic "<request topic>/<function>", so that the
+	// MQTT server can control who may call each function
+	RouteByTopic
+)
+
+// ParseRouting parses "body", "topic" or "both"
+func ParseRouting(text string) (Routing, error) {
+	switch strings.ToLower(text) {
+	case "body":
+		return RouteByBody, nil
+	case "topic":
+		return RouteByTopic, nil
+	case "both":
+		return RouteByBody | RouteByTopic, nil
+	}
+	return 0, fmt.Errorf("unexpected routing: %s", text)
+}
+
+// FunctionTopic returns the topic requests for the function are published to when routing by topic
+func FunctionTopic(requestTopic string, function string) (string, error) {
+	if function == "" || strings.ContainsAny(function, "/+#") {
+		return "", fmt.Errorf("function cannot be routed by topic: '%s'", function)
+	}
+	return fmt.Sprintf("%s/%s", requestTopic, function), nil
+}
+
+// FunctionFromTopic returns the function a request published to the topic is for, or
+// false when the topic is not a function topic
+func FunctionFromTopic(requestTopic string, topic string) (string, bool) {
+	function, found := strings.CutPrefix(topic, requestTopic+"/")
+	if !found || function == "" || strings.Contains(function, "/") {
+		return "", false
+	}
+	return function, true
+}
+
+// CancelTopic returns the topic which messages cancelling requests sent to the request
+// topic are published to. Servers subscribe to it without sharing it, so that the
+// server of a group which has the request receives its cancel message
+func CancelTopic(requestTopic string) string {
+	return fmt.Sprintf("cancel/%s", requestTopic)
+}
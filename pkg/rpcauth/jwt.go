@@ -0,0 +1,148 @@
+package rpcauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Roles     []string `json:"roles,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+}
+
+// JWT authenticates JSON Web Tokens signed with HMAC SHA-256 (HS256). The principal
+// is given by the "sub" claim and a "roles" claim, and tokens are rejected outside
+// their "nbf" and "exp" times
+type JWT struct {
+	key []byte
+	now func() time.Time
+}
+
+// MinJWTKeySize is the shortest key accepted for signing tokens, which is the size of
+// the SHA-256 hash
+const MinJWTKeySize = 32
+
+// NewJWT returns an authenticator of tokens signed with the key, which must have at
+// least MinJWTKeySize bytes and not be only whitespace
+func NewJWT(key []byte) (*JWT, error) {
+	if len(bytes.TrimSpace(key)) == 0 {
+		return nil, errors.New("the JWT key is empty")
+	}
+	if len(key) < MinJWTKeySize {
+		return nil, fmt.Errorf("the JWT key must have at least %d bytes, not %d", MinJWTKeySize, len(key))
+	}
+	return &JWT{key: key, now: time.Now}, nil
+}
+
+// LoadJWT reads the key from a file, ignoring a trailing line ending, and returns an
+// authenticator of tokens signed with it
+func LoadJWT(path string) (*JWT, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := NewJWT(bytes.TrimRight(b, "\r\n"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file '%s': %w", path, err)
+	}
+	return j, nil
+}
+
+func (j *JWT) Authenticate(token string) (*Principal, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid token: not a JWT")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("invalid token: unexpected algorithm '%s'", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, j.sign(parts[0]+"."+parts[1])) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+
+	now := j.now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("token not yet valid")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("invalid token: missing subject")
+	}
+
+	return &Principal{Subject: claims.Subject, Roles: claims.Roles}, nil
+}
+
+// Issue returns a token for the principal which expires after ttl (0 means never)
+func (j *JWT) Issue(p Principal, ttl time.Duration) (string, error) {
+
+	claims := jwtClaims{Subject: p.Subject, Roles: p.Roles}
+	if ttl > 0 {
+		claims.ExpiresAt = j.now().Add(ttl).Unix()
+	}
+
+	header, err := encodeSegment(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := header + "." + payload
+	return signed + "." + base64.RawURLEncoding.EncodeToString(j.sign(signed)), nil
+}
+
+func (j *JWT) sign(signed string) []byte {
+	mac := hmac.New(sha256.New, j.key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+func encodeSegment(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,59 @@
+package rpcauth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadJWTRejectsWeakKeys(t *testing.T) {
+	dir := t.TempDir()
+	for name, key := range map[string]string{
+		"empty":      "",
+		"newline":    "\n",
+		"whitespace": strings.Repeat(" ", MinJWTKeySize) + "\n",
+		"short":      "secret\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(key), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadJWT(path); err == nil {
+			t.Errorf("%s: expected the key to be rejected", name)
+		}
+	}
+}
+
+func TestLoadJWTIgnoresTheLineEnding(t *testing.T) {
+	key := strings.Repeat("k", MinJWTKeySize)
+	dir := t.TempDir()
+
+	// A token issued with the key from a file with a line ending is accepted by the
+	// key from a file without one
+	var jwts []*JWT
+	for name, content := range map[string]string{"lf": key + "\n", "crlf": key + "\r\n", "none": key} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		j, err := LoadJWT(path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		jwts = append(jwts, j)
+	}
+
+	for _, issuer := range jwts {
+		token, err := issuer.Issue(Principal{Subject: "alice"}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, j := range jwts {
+			if p, err := j.Authenticate(token); err != nil || p.Subject != "alice" {
+				t.Fatalf("expected the token to be accepted: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package rpcauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcserver"
+)
+
+// Rule allows the callers it names to call the functions matching its patterns. A
+// caller is named by its subject in Principals or by one of its roles in Roles, and
+// the principal "*" names every caller, including those which are not authenticated.
+// Functions are patterns as understood by path.Match
+type Rule struct {
+	Principals []string `json:"principals,omitempty"`
+	Roles      []string `json:"roles,omitempty"`
+	Functions  []string `json:"functions"`
+}
+
+// Policy says who may call what. A call is allowed when any rule allows it, and
+// denied otherwise
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadPolicy reads a policy from a JSON file such as:
+//
+//	{"rules": [
+//	    {"roles": ["admin"], "functions": ["*"]},
+//	    {"principals": ["*"], "functions": ["buildinfo", "calculator"]}
+//	]}
+func LoadPolicy(filename string) (*Policy, error) {
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("could not parse policy file '%s': %w", filename, err)
+	}
+	for i, rule := range p.Rules {
+		for _, pattern := range rule.Functions {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("policy file '%s', rule %d: bad function pattern '%s'", filename, i, pattern)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Allows reports whether the principal, which is nil for a caller which is not
+// authenticated, may call the function
+func (p *Policy) Allows(principal *Principal, function string) bool {
+	for _, rule := range p.Rules {
+		if rule.names(principal) && rule.matches(function) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) names(principal *Principal) bool {
+	for _, name := range r.Principals {
+		if name == "*" || (principal != nil && name == principal.Subject) {
+			return true
+		}
+	}
+	if principal == nil {
+		return false
+	}
+	for _, role := range r.Roles {
+		for _, have := range principal.Roles {
+			if role == have {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r Rule) matches(function string) bool {
+	for _, pattern := range r.Functions {
+		if ok, _ := path.Match(pattern, function); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyFile is a policy loaded from a file, which can be reloaded while requests are
+// being authorized
+type PolicyFile struct {
+	filename string
+
+	mu     sync.RWMutex
+	policy *Policy
+}
+
+func NewPolicyFile(filename string) (*PolicyFile, error) {
+	f := &PolicyFile{filename: filename}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again. The current policy is kept if the file cannot be read
+func (f *PolicyFile) Reload() error {
+	p, err := LoadPolicy(f.filename)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.policy = p
+	return nil
+}
+
+// Policy returns the current policy
+func (f *PolicyFile) Policy() *Policy {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.policy
+}
+
+// Authorize returns a server interceptor which denies requests that the policy does
+// not allow with PermissionDenied, logging each denial. It must run after the
+// interceptor which authenticates requests
+func Authorize(policy *PolicyFile) rpcserver.Interceptor {
+	return func(ctx context.Context, req request.Request, next rpcserver.HandlerFunc) (*response.Response, bool, error) {
+
+		principal, _ := PrincipalFrom(ctx)
+		if !policy.Policy().Allows(principal, req.Function) {
+			subject := "anonymous caller"
+			if principal != nil {
+				subject = fmt.Sprintf("'%s'", principal.Subject)
+			}
+			slog.Info(fmt.Sprintf("denied %s calling '%s'", subject, req.Function))
+			return nil, false, rpcerr.New(rpcerr.PermissionDenied, fmt.Sprintf("not allowed to call '%s'", req.Function))
+		}
+
+		return next(ctx, req)
+	}
+}
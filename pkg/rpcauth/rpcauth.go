@@ -0,0 +1,73 @@
+package rpcauth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcserver"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Subject string   `json:"subject"`
+	Roles   []string `json:"roles,omitempty"`
+}
+
+// Authenticator returns the principal a bearer token belongs to, or an error when the
+// token is not valid
+type Authenticator interface {
+	Authenticate(token string) (*Principal, error)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context holding the principal
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the authenticated caller of the request being handled in the
+// context
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Interceptor returns a server interceptor which authenticates every request with the
+// bearer token in its authorization user property. Requests without a valid token are
+// rejected as Unauthenticated, and the principal of the others is put in the context
+// of the handler
+func Interceptor(a Authenticator) rpcserver.Interceptor {
+	return func(ctx context.Context, req request.Request, next rpcserver.HandlerFunc) (*response.Response, bool, error) {
+
+		var authorization string
+		if props := rpcserver.Properties(ctx); props != nil {
+			authorization = props.User.Get(rpc.AuthorizationProperty)
+		}
+		if authorization == "" {
+			slog.Info(fmt.Sprintf("rejecting request for '%s' without a bearer token", req.Function))
+			return nil, false, rpcerr.New(rpcerr.Unauthenticated, "missing bearer token")
+		}
+
+		scheme, token, found := strings.Cut(authorization, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			slog.Info(fmt.Sprintf("rejecting request for '%s' with a malformed authorization", req.Function))
+			return nil, false, rpcerr.New(rpcerr.Unauthenticated, "authorization is not a bearer token")
+		}
+
+		p, err := a.Authenticate(token)
+		if err != nil {
+			slog.Info(fmt.Sprintf("rejecting request for '%s': %s", req.Function, err))
+			return nil, false, rpcerr.New(rpcerr.Unauthenticated, err.Error())
+		}
+
+		// The subject identifies the caller of duplicate requests
+		return next(rpcserver.WithCaller(WithPrincipal(ctx, p), p.Subject), req)
+	}
+}
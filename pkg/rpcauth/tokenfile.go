@@ -0,0 +1,51 @@
+package rpcauth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Tokens authenticates a fixed set of tokens, each belonging to a principal
+type Tokens struct {
+	tokens map[string]Principal
+}
+
+// LoadTokens reads a JSON file which maps each token to its principal:
+//
+//	{"<token>": {"subject": "alice", "roles": ["admin"]}}
+func LoadTokens(path string) (*Tokens, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens map[string]Principal
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("could not parse token file '%s': %w", path, err)
+	}
+	for token, p := range tokens {
+		if token == "" || p.Subject == "" {
+			return nil, fmt.Errorf("token file '%s' has a token without a subject", path)
+		}
+	}
+	return &Tokens{tokens: tokens}, nil
+}
+
+func (t *Tokens) Authenticate(token string) (*Principal, error) {
+	// Every token is compared, so that the time taken does not reveal a near match
+	var found *Principal
+	for candidate, p := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			p := p
+			found = &p
+		}
+	}
+	if found == nil {
+		return nil, errors.New("unknown token")
+	}
+	return found, nil
+}
@@ -0,0 +1,110 @@
+package rpcclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+)
+
+// BatchFunction is the function which interceptors are given for a batch
+const BatchFunction = "(batch)"
+
+// BatchCall is one call of a batch
+type BatchCall struct {
+	Function string
+	Args     map[string]any
+}
+
+// CallBatch sends the calls as a single batch request, which is always published to
+// the request topic, and waits for the reply. The responses are returned in the order
+// of the calls, each with its own code, so that a failed call does not fail the others;
+// use rpcerr.FromResponse to get the error of a call. An error is returned only when
+// the batch as a whole could not be handled
+func (c *Client) CallBatch(ctx context.Context, calls []BatchCall, opts ...CallOption) ([]*response.Response, error) {
+	o := callOptions{qos: c.opts.QoS}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.qos > 2 {
+		return nil, fmt.Errorf("unexpected qos: %d", o.qos)
+	}
+
+	format, ok := c.opts.Format.(rpc.BatchFormat)
+	if !ok {
+		return nil, fmt.Errorf("format '%s' does not support batches", c.opts.Format.ContentType())
+	}
+	if len(calls) == 0 {
+		return nil, errors.New("empty batch")
+	}
+
+	cID := c.nextID()
+	reqs := make([]*request.Request, len(calls))
+	ids := make([]any, len(calls))
+	for i, call := range calls {
+		reqs[i] = request.New(call.Function)
+		for key, value := range call.Args {
+			reqs[i].Args[key] = value
+		}
+		ids[i] = fmt.Sprintf("%s.%d", cID, i)
+	}
+
+	j, err := format.EncodeBatchRequest(reqs, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// The interceptors see the batch as a call of BatchFunction, whose reply they are
+	// not given
+	var resps []*response.Response
+	invoke := chain(c.opts.Interceptors, func(ctx context.Context, function string, pb *paho.Publish) (*response.Response, error) {
+		attempt := string(pb.Properties.CorrelationData)
+		rChan, err := c.addCall(attempt, o.progress)
+		if err != nil {
+			return nil, err
+		}
+		defer c.removeCall(attempt)
+
+		reply, err := c.send(ctx, pb, rChan)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := rpc.FormatFor(reply.Properties.ContentType)
+		if err != nil {
+			return nil, err
+		}
+
+		// A batch which could not be handled is answered with a single response
+		replyFormat, ok := f.(rpc.BatchFormat)
+		if !ok || !replyFormat.IsBatch(reply.Payload) {
+			resp, err := f.DecodeResponse(reply.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("could not decode response: %w", err)
+			}
+			if err := rpcerr.FromResponse(resp); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("unexpected response to a batch request")
+		}
+
+		resps, err = replyFormat.DecodeBatchResponse(reply.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode batch response: %w", err)
+		}
+		if len(resps) != len(calls) {
+			return nil, fmt.Errorf("unexpected number of responses: %d, expected %d", len(resps), len(calls))
+		}
+		return nil, nil
+	})
+
+	if _, err := invoke(ctx, BatchFunction, c.newPublish(c.opts.RequestTopic, cID, format, j, o)); err != nil {
+		return nil, err
+	}
+	return resps, nil
+}
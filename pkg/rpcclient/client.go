@@ -0,0 +1,471 @@
+/* see:
+ *    https://github.com/eclipse/paho.golang/blob/v0.21.0/autopaho/examples/basics/basics.go
+ *    https://github.com/eclipse/paho.golang/blob/master/autopaho/extensions/rpc/rpc.go
+ */
+
+package rpcclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/clientid"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+	"google.golang.org/protobuf/proto"
+)
+
+// Options configure a Client
+type Options struct {
+	// Config holds the connection settings. OnConnectionUp and OnPublishReceived are
+	// set by the client; ClientID defaults to a unique ID starting with ClientIDPrefix.
+	// Replies are received on the topic "response/<ClientID>"
+	Config autopaho.ClientConfig
+
+	// ClientIDPrefix is the prefix of the generated client ID (defaults to "requester")
+	ClientIDPrefix string
+
+	// RequestTopic is the topic requests are sent to (defaults to "request")
+	RequestTopic string
+
+	// Routing says where requests are published (defaults to rpc.RouteByBody). When
+	// routing by topic, requests are published to "<RequestTopic>/<function>"
+	Routing rpc.Routing
+
+	// QoS is the quality of service with which requests are published, unless
+	// overridden for a call by WithQoS
+	QoS byte
+
+	// ReplyQoS is the quality of service of the subscription to the response topic
+	ReplyQoS byte
+
+	// Interceptors run around every call, batch and stream, in order, the first
+	// outermost
+	Interceptors []Interceptor
+
+	// Format is the format requests are sent in (defaults to rpc.Native). Replies are
+	// decoded in the format given by their content type
+	Format rpc.Format
+
+	// Token is a bearer token sent with every request, including batches and streams,
+	// in the authorization user property
+	Token string
+}
+
+// CallOption configures a single call
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	qos            byte
+	progress       func(percent float64, message string)
+	idempotencyKey string
+}
+
+// WithQoS sets the quality of service with which the request is published
+func WithQoS(qos byte) CallOption {
+	return func(o *callOptions) {
+		o.qos = qos
+	}
+}
+
+// WithProgress sets a function which is called with each progress report of the
+// handler. It is called on the receive goroutine of the client, so must not block
+func WithProgress(progress func(percent float64, message string)) CallOption {
+	return func(o *callOptions) {
+		o.progress = progress
+	}
+}
+
+// WithIdempotencyKey identifies the request, so that a Responder which suppresses
+// duplicates answers a request with the same key from the same caller with the
+// response to the first rather than handling it again. The caller is the one
+// authenticated by the Responder or, without authentication, the client
+func WithIdempotencyKey(key string) CallOption {
+	return func(o *callOptions) {
+		o.idempotencyKey = key
+	}
+}
+
+// Client makes requests to a Responder over a single connection. It is safe for
+// concurrent use by multiple goroutines
+type Client struct {
+	opts          Options
+	cm            *autopaho.ConnectionManager
+	responseTopic string
+
+	mu       sync.Mutex
+	calls    map[string]chan *paho.Publish
+	streams  map[string]*Stream
+	progress map[string]func(percent float64, message string)
+}
+
+// Dial connects to the MQTT server and returns once the response topic has been
+// subscribed to (otherwise we might send a request before the subscription is in place)
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	if opts.RequestTopic == "" {
+		opts.RequestTopic = "request"
+	}
+	if opts.Routing == 0 {
+		opts.Routing = rpc.RouteByBody
+	}
+	if opts.Format == nil {
+		opts.Format = rpc.Native
+	}
+	if opts.QoS > 2 || opts.ReplyQoS > 2 {
+		return nil, fmt.Errorf("unexpected qos: %d, reply qos: %d", opts.QoS, opts.ReplyQoS)
+	}
+
+	if opts.ClientIDPrefix == "" {
+		opts.ClientIDPrefix = "requester"
+	}
+
+	config := opts.Config
+	if config.ClientID == "" {
+		config.ClientID = clientid.New(opts.ClientIDPrefix)
+	}
+
+	c := &Client{
+		opts:          opts,
+		responseTopic: fmt.Sprintf("response/%s", config.ClientID),
+		calls:         make(map[string]chan *paho.Publish),
+		streams:       make(map[string]*Stream),
+		progress:      make(map[string]func(percent float64, message string)),
+	}
+
+	initialSubscriptionMade := make(chan struct{}) // Closed when subscription made
+	var initialSubscriptionOnce sync.Once          // We only want to close the above once!
+
+	config.OnConnectionUp = func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5*time.Second))
+		defer cancel()
+
+		// Subscribe to the responseTopic
+		if _, err := cm.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{
+				{Topic: c.responseTopic, QoS: opts.ReplyQoS},
+			},
+		}); err != nil {
+			slog.Warn(fmt.Sprintf("requestor failed to subscribe (%s). This is likely to mean no messages will be received.", err))
+			return
+		}
+		initialSubscriptionOnce.Do(func() { close(initialSubscriptionMade) })
+	}
+	config.OnPublishReceived = append(config.OnPublishReceived, func(received paho.PublishReceived) (bool, error) {
+		return c.onPublishReceived(received.Packet), nil
+	})
+
+	// The connection outlives the dial context; it is closed by Disconnect
+	cm, err := autopaho.NewConnection(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+	c.cm = cm
+
+	select {
+	case <-ctx.Done():
+		_ = cm.Disconnect(context.Background())
+		return nil, fmt.Errorf("requestor failed to connect & subscribe: %w", ctx.Err())
+	case <-initialSubscriptionMade:
+	}
+
+	return c, nil
+}
+
+// Disconnect closes the connection to the MQTT server
+func (c *Client) Disconnect(ctx context.Context) error {
+	return c.cm.Disconnect(ctx)
+}
+
+// ErrStreamed is returned by Call for a function which streams its response, which
+// must be called with CallStream
+var ErrStreamed = errors.New("function streams its response; use CallStream")
+
+// Call sends a request for the named function and waits for the reply. A reply which
+// is not ok is returned as an *rpcerr.Error
+func (c *Client) Call(ctx context.Context, function string, args map[string]any, opts ...CallOption) (*response.Response, error) {
+	return c.call(ctx, function, args, c.opts.Format, opts)
+}
+
+// CallProto calls a typed handler whose request and response are protobuf messages,
+// sending in in the rpc.Protobuf format whatever the format of the client, and
+// decoding the reply into out
+func (c *Client) CallProto(ctx context.Context, function string, in proto.Message, out proto.Message, opts ...CallOption) error {
+
+	b, err := proto.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.call(ctx, function, map[string]any{rpc.ProtobufKey: b}, rpc.Protobuf, opts)
+	if err != nil {
+		return err
+	}
+
+	result, ok := (*resp)[rpc.ProtobufKey].([]byte)
+	if !ok {
+		return fmt.Errorf("the reply of '%s' does not hold a protobuf message", function)
+	}
+	return proto.Unmarshal(result, out)
+}
+
+func (c *Client) call(ctx context.Context, function string, args map[string]any, format rpc.Format, opts []CallOption) (*response.Response, error) {
+	o := callOptions{qos: c.opts.QoS}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.qos > 2 {
+		return nil, fmt.Errorf("unexpected qos: %d", o.qos)
+	}
+
+	topic := c.opts.RequestTopic
+	if c.opts.Routing&rpc.RouteByTopic != 0 {
+		var err error
+		if topic, err = rpc.FunctionTopic(c.opts.RequestTopic, function); err != nil {
+			return nil, err
+		}
+	}
+
+	r := request.New(function)
+	for key, value := range args {
+		r.Args[key] = value
+	}
+
+	cID := c.nextID()
+	j, err := format.EncodeRequest(r, cID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The reply is waited for by each attempt, so that an interceptor can retry
+	invoke := chain(c.opts.Interceptors, func(ctx context.Context, function string, pb *paho.Publish) (*response.Response, error) {
+		attempt := string(pb.Properties.CorrelationData)
+		rChan, err := c.addCall(attempt, o.progress)
+		if err != nil {
+			return nil, err
+		}
+		defer c.removeCall(attempt)
+
+		reply, err := c.send(ctx, pb, rChan)
+		if err != nil {
+			return nil, err
+		}
+
+		format, err := rpc.FormatFor(reply.Properties.ContentType)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := format.DecodeResponse(reply.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode response: %w", err)
+		}
+
+		// The reply is the first message of a stream. A stream which ended at once with
+		// an error gives that error, and otherwise the rest of the stream is cancelled
+		if kind := rpc.Kind(reply.Properties); kind != "" {
+			if err := rpcerr.FromResponse(resp); err != nil && kind == rpc.KindEnd {
+				return nil, err
+			}
+			if kind != rpc.KindEnd {
+				c.cancel(attempt, pb.QoS)
+			}
+			return nil, fmt.Errorf("'%s': %w", function, ErrStreamed)
+		}
+
+		if err := rpcerr.FromResponse(resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	})
+
+	return invoke(ctx, function, c.newPublish(topic, cID, format, j, o))
+}
+
+// send publishes the request and waits for its reply. When the context is done
+// first, the Responder is asked to cancel the request
+func (c *Client) send(ctx context.Context, pb *paho.Publish, rChan chan *paho.Publish) (*paho.Publish, error) {
+
+	if err := c.publish(ctx, pb); err != nil {
+		return nil, err
+	}
+
+	var reply *paho.Publish
+	select {
+	case <-ctx.Done():
+		c.cancel(string(pb.Properties.CorrelationData), pb.QoS)
+		return nil, ctx.Err()
+	case reply = <-rChan:
+	}
+
+	slog.Debug(fmt.Sprintf("Received response: %s", reply.Payload))
+	return reply, nil
+}
+
+// publish sends the request, passing on the deadline of the context
+func (c *Client) publish(ctx context.Context, pb *paho.Publish) error {
+
+	// Pass the deadline on to the Responder as the message expiry interval
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return context.DeadlineExceeded
+		}
+		expiry := uint32(math.Min(math.Ceil(remaining.Seconds()), math.MaxUint32))
+		pb.Properties.MessageExpiry = &expiry
+	}
+
+	slog.Debug(fmt.Sprintf("Sending request: %s", pb.Payload))
+	_, err := c.cm.Publish(ctx, pb)
+	return err
+}
+
+// newPublish returns the message of a request in the format
+func (c *Client) newPublish(topic string, cID string, format rpc.Format, j []byte, o callOptions) *paho.Publish {
+
+	pb := &paho.Publish{
+		QoS:   o.qos,
+		Topic: topic,
+		Properties: &paho.PublishProperties{
+			CorrelationData: []byte(cID),
+			ResponseTopic:   c.responseTopic,
+			ContentType:     format.ContentType(),
+		},
+		Payload: j,
+	}
+	if c.opts.Token != "" {
+		pb.Properties.User = append(pb.Properties.User, paho.UserProperty{Key: rpc.AuthorizationProperty, Value: "Bearer " + c.opts.Token})
+	}
+	if o.idempotencyKey != "" {
+		pb.Properties.User = append(pb.Properties.User, paho.UserProperty{Key: rpc.IdempotencyKeyProperty, Value: o.idempotencyKey})
+	}
+	return pb
+}
+
+// cancel publishes a message asking the Responder to stop handling the request, to the
+// cancel topic of the request topic, which every Responder of a group receives
+func (c *Client) cancel(cID string, qos byte) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The cancel carries the authorization of the request, which the Responder checks
+	pb := &paho.Publish{
+		QoS:   qos,
+		Topic: rpc.CancelTopic(c.opts.RequestTopic),
+		Properties: &paho.PublishProperties{
+			CorrelationData: []byte(cID),
+			ResponseTopic:   c.responseTopic,
+			User:            paho.UserProperties{{Key: rpc.KindProperty, Value: rpc.KindCancel}},
+		},
+	}
+	if c.opts.Token != "" {
+		pb.Properties.User = append(pb.Properties.User, paho.UserProperty{Key: rpc.AuthorizationProperty, Value: "Bearer " + c.opts.Token})
+	}
+
+	slog.Debug(fmt.Sprintf("Cancelling request: %s", cID))
+	_, err := c.cm.Publish(ctx, pb)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("failed to cancel request: %s", err))
+	}
+}
+
+// addCall registers a call waiting for the reply with the correlation ID. A call may
+// wait for one reply at a time
+func (c *Client) addCall(cID string, progress func(percent float64, message string)) (chan *paho.Publish, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.calls[cID]; ok {
+		return nil, fmt.Errorf("already waiting for the reply to %q", cID)
+	}
+	rChan := make(chan *paho.Publish, 1)
+	c.calls[cID] = rChan
+	if progress != nil {
+		c.progress[cID] = progress
+	}
+	return rChan, nil
+}
+
+// nextID returns a new correlation ID, which is random so that a client which
+// restarts with the same client ID does not reuse the IDs of its earlier requests,
+// and have a Responder which suppresses duplicates take them as duplicates
+func (c *Client) nextID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("could not generate correlation ID: %s", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+func (c *Client) removeCall(cID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.calls, cID)
+	delete(c.progress, cID)
+}
+
+func (c *Client) onPublishReceived(pb *paho.Publish) bool {
+	if pb.Topic != c.responseTopic || pb.Properties == nil || pb.Properties.CorrelationData == nil {
+		return false
+	}
+
+	// Progress reports are not replies, so are passed to the progress function, if any
+	if rpc.Kind(pb.Properties) == rpc.KindProgress {
+		c.onProgress(pb)
+		return true
+	}
+
+	c.mu.Lock()
+	if stream := c.streams[string(pb.Properties.CorrelationData)]; stream != nil {
+		c.mu.Unlock()
+		stream.push(pb)
+		return true
+	}
+	rChan := c.calls[string(pb.Properties.CorrelationData)]
+	delete(c.calls, string(pb.Properties.CorrelationData))
+	c.mu.Unlock()
+
+	// Replies to calls which have given up, or which are not ours, are discarded
+	if rChan == nil {
+		slog.Debug(fmt.Sprintf("discarding reply with unknown correlation data: %q", pb.Properties.CorrelationData))
+		return true
+	}
+
+	rChan <- pb
+	return true
+}
+
+func (c *Client) onProgress(pb *paho.Publish) {
+	c.mu.Lock()
+	progress := c.progress[string(pb.Properties.CorrelationData)]
+	c.mu.Unlock()
+	if progress == nil {
+		return
+	}
+
+	format, err := rpc.FormatFor(pb.Properties.ContentType)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("discarding progress: %s", err))
+		return
+	}
+	resp, err := format.DecodeResponse(pb.Payload)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("discarding progress which could not be decoded: %s", err))
+		return
+	}
+
+	percent, _ := resp.GetNumber("percent")
+	message, _ := resp.GetMessage()
+	progress(percent, message)
+}
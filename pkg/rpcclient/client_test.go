@@ -0,0 +1,27 @@
+package rpcclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestPublishAfterTheDeadline(t *testing.T) {
+	for _, ago := range []time.Duration{0, time.Millisecond, 2 * time.Second, time.Hour} {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-ago))
+		pb := &paho.Publish{Properties: &paho.PublishProperties{}}
+
+		// The client is not connected, so the request must not get as far as publishing
+		err := new(Client).publish(ctx, pb)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s after the deadline: expected %v, got %v", ago, context.DeadlineExceeded, err)
+		}
+		if pb.Properties.MessageExpiry != nil {
+			t.Fatalf("%s after the deadline: unexpected message expiry %d", ago, *pb.Properties.MessageExpiry)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package rpcclient
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+)
+
+// Invoker publishes the request for the named function and returns the decoded reply,
+// or the error held in a reply which is not ok. Each call is an attempt, which
+// publishes the message and waits for the reply to its correlation data. For a batch
+// the function is BatchFunction, and for a batch or a stream no reply is returned:
+// the invoker of a batch returns once the batch is answered, and that of a stream
+// once the request is published
+type Invoker func(ctx context.Context, function string, pb *paho.Publish) (*response.Response, error)
+
+// Interceptor runs around a call. It may change the message of the request, such as
+// its user properties, before calling next to send it, and may change the reply or
+// the error which next returns. It may call next more than once, to retry the call;
+// a Responder which suppresses duplicates answers a retry with the same correlation
+// data with the response to the first attempt. The response topic of the message
+// must not be changed
+type Interceptor func(ctx context.Context, function string, pb *paho.Publish, next Invoker) (*response.Response, error)
+
+// chain returns the invoker wrapped in the interceptors, the first outermost
+func chain(interceptors []Interceptor, invoker Invoker) Invoker {
+	next := invoker
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func(ctx context.Context, function string, pb *paho.Publish) (*response.Response, error) {
+			return interceptor(ctx, function, pb, inner)
+		}
+	}
+	return next
+}
+
+// Logging returns an interceptor which logs each call with the code of its reply and
+// how long it took
+func Logging() Interceptor {
+	return func(ctx context.Context, function string, pb *paho.Publish, next Invoker) (*response.Response, error) {
+		start := time.Now()
+		resp, err := next(ctx, function, pb)
+		duration := time.Since(start)
+
+		code := rpcerr.CodeOf(err)
+		slog.Info(fmt.Sprintf("call '%s': %d (%s) in %s", function, int(code), code, duration))
+		return resp, err
+	}
+}
+
+// Metadata returns an interceptor which adds the metadata to every request as user
+// properties
+func Metadata(metadata map[string]string) Interceptor {
+
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return func(ctx context.Context, function string, pb *paho.Publish, next Invoker) (*response.Response, error) {
+		for _, key := range keys {
+			pb.Properties.User.Add(key, metadata[key])
+		}
+		return next(ctx, function, pb)
+	}
+}
@@ -0,0 +1,106 @@
+//go:build integration
+
+package rpcclient_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/clientid"
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/testbroker"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcclient"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcserver"
+)
+
+// serve runs a Responder with the handler until the end of the test, and returns a
+// client of it with the interceptors
+func serve(t *testing.T, function string, handler rpcserver.HandlerFunc, interceptors ...rpcclient.Interceptor) *rpcclient.Client {
+	t.Helper()
+
+	config := testbroker.Config(t)
+	requestTopic := clientid.New("test/interceptor")
+
+	s := rpcserver.New(rpcserver.Options{Config: config, RequestTopic: requestTopic})
+	s.RegisterContext(function, handler)
+	testbroker.Serve(t, s)
+
+	dctx, dcancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer dcancel()
+	client, err := rpcclient.Dial(dctx, rpcclient.Options{Config: config, RequestTopic: requestTopic, Interceptors: interceptors})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client
+}
+
+// retry is an interceptor which retries a call while it is rejected as unavailable
+func retry(attempts int) rpcclient.Interceptor {
+	return func(ctx context.Context, function string, pb *paho.Publish, next rpcclient.Invoker) (*response.Response, error) {
+		for i := 1; ; i++ {
+			resp, err := next(ctx, function, pb)
+			if i == attempts || !errors.Is(err, rpcerr.ErrUnavailable) {
+				return resp, err
+			}
+		}
+	}
+}
+
+func TestInterceptorRetries(t *testing.T) {
+	var handled atomic.Int32
+	client := serve(t, "flaky", func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+		if handled.Add(1) < 3 {
+			return nil, false, rpcerr.New(rpcerr.Unavailable, "try again")
+		}
+		return response.New(http.StatusOK), false, nil
+	}, retry(3))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Call(ctx, "flaky", nil); err != nil {
+		t.Fatalf("expected the call to succeed on its third attempt: %s", err)
+	}
+	if n := handled.Load(); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestInterceptorsRunForBatchesAndStreams(t *testing.T) {
+	metadata := make(chan string, 3)
+	client := serve(t, "echo", func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+		metadata <- rpcserver.Properties(ctx).User.Get("tenant")
+		return response.New(http.StatusOK), false, nil
+	}, rpcclient.Metadata(map[string]string{"tenant": "test"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.Call(ctx, "echo", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CallBatch(ctx, []rpcclient.BatchCall{{Function: "echo"}}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.CallStream(ctx, "echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, call := range []string{"call", "batch", "stream"} {
+		if tenant := <-metadata; tenant != "test" {
+			t.Fatalf("expected the %s to carry the metadata, got %q", call, tenant)
+		}
+	}
+}
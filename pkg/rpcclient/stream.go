@@ -0,0 +1,218 @@
+package rpcclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+)
+
+// ErrBrokenStream is returned by Recv when a message of a stream has been lost
+var ErrBrokenStream = errors.New("broken stream")
+
+// Stream receives the messages of a streaming response. Recv and Close must not be
+// called concurrently
+type Stream struct {
+	c   *Client
+	ctx context.Context
+	cID string
+	qos byte
+
+	mu      sync.Mutex
+	queue   []*paho.Publish
+	arrived chan struct{} // signalled when a message is queued
+
+	seq int   // sequence number of the next message
+	err error // returned by Recv once the stream has finished
+}
+
+// CallStream sends a request for the named function and returns the stream of its
+// response. The context bounds the whole stream, and its deadline is passed on to the
+// Responder. A function which does not stream its response gives a stream of one message
+func (c *Client) CallStream(ctx context.Context, function string, args map[string]any, opts ...CallOption) (*Stream, error) {
+	o := callOptions{qos: c.opts.QoS}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.qos > 2 {
+		return nil, fmt.Errorf("unexpected qos: %d", o.qos)
+	}
+
+	topic := c.opts.RequestTopic
+	if c.opts.Routing&rpc.RouteByTopic != 0 {
+		var err error
+		if topic, err = rpc.FunctionTopic(c.opts.RequestTopic, function); err != nil {
+			return nil, err
+		}
+	}
+
+	r := request.New(function)
+	for key, value := range args {
+		r.Args[key] = value
+	}
+
+	stream := c.addStream(ctx, o)
+
+	j, err := c.opts.Format.EncodeRequest(r, stream.cID)
+	if err != nil {
+		stream.remove()
+		return nil, err
+	}
+
+	// The interceptors run around publishing the request, as the messages of the
+	// stream are received later by Recv
+	invoke := chain(c.opts.Interceptors, func(ctx context.Context, function string, pb *paho.Publish) (*response.Response, error) {
+		return nil, c.publish(ctx, pb)
+	})
+	if _, err := invoke(ctx, function, c.newPublish(topic, stream.cID, c.opts.Format, j, o)); err != nil {
+		stream.remove()
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (c *Client) addStream(ctx context.Context, o callOptions) *Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stream := &Stream{c: c, ctx: ctx, cID: c.nextID(), qos: o.qos, arrived: make(chan struct{}, 1)}
+	c.streams[stream.cID] = stream
+	if o.progress != nil {
+		c.progress[stream.cID] = o.progress
+	}
+	return stream
+}
+
+// Close stops receiving the stream; messages which arrive later are discarded. A
+// stream closed before its end is cancelled
+func (st *Stream) Close() {
+	if st.err == nil {
+		st.finish(context.Canceled)
+		st.c.cancel(st.cID, st.qos)
+	}
+}
+
+func (st *Stream) remove() {
+	st.c.mu.Lock()
+	defer st.c.mu.Unlock()
+	delete(st.c.streams, st.cID)
+	delete(st.c.progress, st.cID)
+}
+
+// push queues a message, without blocking the receive loop of the client
+func (st *Stream) push(pb *paho.Publish) {
+	st.mu.Lock()
+	st.queue = append(st.queue, pb)
+	st.mu.Unlock()
+
+	select {
+	case st.arrived <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) pop() (*paho.Publish, error) {
+	for {
+		st.mu.Lock()
+		if len(st.queue) > 0 {
+			pb := st.queue[0]
+			st.queue = st.queue[1:]
+			st.mu.Unlock()
+			return pb, nil
+		}
+		st.mu.Unlock()
+
+		select {
+		case <-st.ctx.Done():
+			return nil, st.ctx.Err()
+		case <-st.arrived:
+		}
+	}
+}
+
+// Recv returns the next message of the stream. At the end of the stream it returns
+// io.EOF or, when the stream ended with an error, that error as an *rpcerr.Error. A
+// gap in the sequence numbers of the messages is reported as ErrBrokenStream
+func (st *Stream) Recv() (*response.Response, error) {
+	for st.err == nil {
+		pb, err := st.pop()
+		if err != nil {
+			st.finish(err)
+			st.c.cancel(st.cID, st.qos)
+			break
+		}
+
+		kind := rpc.Kind(pb.Properties)
+		if kind == "" {
+			// A single reply, from a function which does not stream or from a Responder
+			// which rejected the request
+			resp, err := st.decode(pb)
+			if err != nil {
+				st.finish(err)
+				break
+			}
+			st.finish(io.EOF)
+			return resp, nil
+		}
+
+		seq, err := strconv.Atoi(pb.Properties.User.Get(rpc.SeqProperty))
+		if err != nil {
+			st.finish(fmt.Errorf("%w: message without a sequence number", ErrBrokenStream))
+			break
+		}
+		if seq < st.seq {
+			continue // a duplicate
+		}
+		if seq > st.seq {
+			st.finish(fmt.Errorf("%w: expected message %d, got %d", ErrBrokenStream, st.seq, seq))
+			break
+		}
+		st.seq++
+
+		resp, err := st.decode(pb)
+		if err != nil {
+			st.finish(err)
+			break
+		}
+
+		switch kind {
+		case rpc.KindData:
+			return resp, nil
+		case rpc.KindEnd:
+			st.finish(io.EOF)
+		default:
+			st.finish(fmt.Errorf("%w: unexpected kind of message: '%s'", ErrBrokenStream, kind))
+		}
+	}
+	return nil, st.err
+}
+
+// decode returns the response held in the message, or its error when it is not ok
+func (st *Stream) decode(pb *paho.Publish) (*response.Response, error) {
+	format, err := rpc.FormatFor(pb.Properties.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := format.DecodeResponse(pb.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode response: %w", err)
+	}
+	if err := rpcerr.FromResponse(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (st *Stream) finish(err error) {
+	st.err = err
+	st.remove()
+}
@@ -0,0 +1,147 @@
+package rpcerr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+)
+
+// Code is the numeric code of a response. The well known codes have the value of
+// the matching HTTP status, so they map directly onto the 'code' of a response
+type Code int
+
+const (
+	OK                Code = http.StatusOK
+	InvalidArgument   Code = http.StatusBadRequest
+	Unauthenticated   Code = http.StatusUnauthorized
+	PermissionDenied  Code = http.StatusForbidden
+	NotFound          Code = http.StatusNotFound
+	AlreadyExists     Code = http.StatusConflict
+	ResourceExhausted Code = http.StatusTooManyRequests
+	Canceled          Code = 499 // Client Closed Request
+	Internal          Code = http.StatusInternalServerError
+	Unimplemented     Code = http.StatusNotImplemented
+	Unavailable       Code = http.StatusServiceUnavailable
+	DeadlineExceeded  Code = http.StatusGatewayTimeout
+)
+
+var names = map[Code]string{
+	OK:                "OK",
+	InvalidArgument:   "InvalidArgument",
+	Unauthenticated:   "Unauthenticated",
+	PermissionDenied:  "PermissionDenied",
+	NotFound:          "NotFound",
+	AlreadyExists:     "AlreadyExists",
+	ResourceExhausted: "ResourceExhausted",
+	Canceled:          "Canceled",
+	Internal:          "Internal",
+	Unimplemented:     "Unimplemented",
+	Unavailable:       "Unavailable",
+	DeadlineExceeded:  "DeadlineExceeded",
+}
+
+func (c Code) String() string {
+	if name, ok := names[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", int(c))
+}
+
+// Error is an error response from a handler
+type Error struct {
+	Code    Code
+	Message string
+	Details []any
+}
+
+// Errors which match any Error with the same code when used with errors.Is
+var (
+	ErrInvalidArgument   = &Error{Code: InvalidArgument}
+	ErrUnauthenticated   = &Error{Code: Unauthenticated}
+	ErrPermissionDenied  = &Error{Code: PermissionDenied}
+	ErrNotFound          = &Error{Code: NotFound}
+	ErrAlreadyExists     = &Error{Code: AlreadyExists}
+	ErrResourceExhausted = &Error{Code: ResourceExhausted}
+	ErrCanceled          = &Error{Code: Canceled}
+	ErrInternal          = &Error{Code: Internal}
+	ErrUnimplemented     = &Error{Code: Unimplemented}
+	ErrUnavailable       = &Error{Code: Unavailable}
+	ErrDeadlineExceeded  = &Error{Code: DeadlineExceeded}
+)
+
+func New(code Code, message string, details ...any) *Error {
+	return &Error{Code: code, Message: message, Details: details}
+}
+
+func Errorf(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is reports whether the target is an Error with the same code and, if the target
+// has a message, the same message
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code && (t.Message == "" || t.Message == e.Message)
+}
+
+// Response returns the error as a response
+func (e *Error) Response() *response.Response {
+	r := response.New(int(e.Code))
+	r.PutMessage(e.Message)
+	if len(e.Details) > 0 {
+		r.PutDetails(e.Details)
+	}
+	return r
+}
+
+// Convert returns the error as an Error. Context errors are given the matching code
+// and any other error is Internal
+func Convert(err error) *Error {
+	var e *Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, context.DeadlineExceeded):
+		return New(DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return New(Canceled, err.Error())
+	default:
+		return New(Internal, err.Error())
+	}
+}
+
+// CodeOf returns the code of the error, which is OK for a nil error
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	return Convert(err).Code
+}
+
+// FromResponse returns the Error held in a response, or nil when the response is ok
+func FromResponse(r *response.Response) error {
+	if r.Ok() {
+		return nil
+	}
+
+	code, err := r.GetCode()
+	if err != nil {
+		return New(Internal, fmt.Sprintf("response has no code: %s", err))
+	}
+
+	message, _ := r.GetMessage()
+	details, _ := r.GetDetails()
+	return &Error{Code: Code(code), Message: message, Details: details}
+}
@@ -0,0 +1,82 @@
+package rpcserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+)
+
+// handleBatch dispatches the items of a batch request, with up to BatchConcurrency
+// items of all the batches being handled at a time, and publishes their responses as a single reply in the order of the items.
+// Each item is answered with its own code, so a failed item does not fail the batch
+func (s *Server) handleBatch(ctx context.Context, received paho.PublishReceived, format rpc.BatchFormat) {
+
+	reqs, ids, err := format.DecodeBatchRequest(received.Packet.Payload)
+	if err != nil {
+		slog.Info(fmt.Sprintf("rejecting batch request because message could not be decoded: %v", err))
+		s.replyDecodeError(received, format, nil, fmt.Errorf("could not decode batch request: %w", err))
+		return
+	}
+	if len(reqs) == 0 {
+		slog.Info("rejecting empty batch request")
+		s.reply(received, format, nil, rpcerr.New(rpcerr.InvalidArgument, "empty batch request").Response())
+		return
+	}
+
+	resps := make([]*response.Response, len(reqs))
+	var quit atomic.Bool
+
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		s.batch <- struct{}{}
+		wg.Add(1)
+		go func(i int, req request.Request) {
+			defer func() {
+				<-s.batch
+				wg.Done()
+			}()
+			resp, q := s.dispatch(ctx, received, req, nil)
+			resps[i] = resp
+			if q {
+				quit.Store(true)
+			}
+		}(i, *req)
+	}
+	wg.Wait()
+
+	// Notifications are not answered, and a batch of only notifications has no reply
+	answered := 0
+	for i := range resps {
+		if _, notification := ids[i].(rpc.Notification); !notification {
+			resps[answered], ids[answered] = resps[i], ids[i]
+			answered++
+		}
+	}
+	if answered > 0 {
+		s.replyBatch(received, format, ids[:answered], resps[:answered])
+	}
+
+	if quit.Load() {
+		s.stop()
+	}
+}
+
+// replyBatch publishes the responses to the items of a batch as a single reply
+func (s *Server) replyBatch(received paho.PublishReceived, format rpc.BatchFormat, ids []any, resps []*response.Response) {
+
+	body, err := format.EncodeBatchResponse(resps, ids)
+	if err != nil {
+		slog.Error(fmt.Sprintf("could not encode batch response: %s", err))
+		s.reply(received, format, nil, rpcerr.Errorf(rpcerr.Internal, "could not encode batch response: %s", err).Response())
+		return
+	}
+	s.publish(received, format, body, nil)
+}
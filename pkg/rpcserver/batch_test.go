@@ -0,0 +1,139 @@
+package rpcserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+)
+
+func TestBatchConcurrencyIsSharedByBatches(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 2, BatchConcurrency: 2})
+
+	var running, most atomic.Int32
+	s.RegisterContext("slow", HandlerFunc(func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+		n := running.Add(1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		running.Add(-1)
+		return response.New(http.StatusOK), false, nil
+	}))
+
+	batch := rpc.Native.(rpc.BatchFormat)
+	reqs := []*request.Request{request.New("slow"), request.New("slow"), request.New("slow")}
+	body, err := batch.EncodeBatchRequest(reqs, make([]any, len(reqs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both workers handle a batch at once, but only two items run at a time
+	for _, cID := range []string{"1", "2"} {
+		r := received(t, client, cID, "")
+		r.Packet.Payload = body
+		s.onPublishReceived(r)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case pb := <-published:
+			resps, err := batch.DecodeBatchResponse(pb.Payload)
+			if err != nil || len(resps) != len(reqs) {
+				t.Fatalf("unexpected batch reply: %s (%v)", pb.Payload, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reply was published")
+		}
+	}
+
+	if n := most.Load(); n > 2 {
+		t.Errorf("expected at most 2 items to run at once, got %d", n)
+	}
+}
+
+func TestNotificationsAreNotAnswered(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1})
+
+	var handled atomic.Int32
+	s.RegisterContext("log", HandlerFunc(func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+		handled.Add(1)
+		return response.New(http.StatusOK), false, nil
+	}))
+
+	notification := `{"jsonrpc": "2.0", "method": "log"}`
+	for cID, payload := range map[string]string{
+		"single":              notification,
+		"notifications":       `[` + notification + `, ` + notification + `]`,
+		"invalid params":      `{"jsonrpc": "2.0", "method": "log", "params": [1]}`,
+		"batch with requests": `[` + notification + `, {"jsonrpc": "2.0", "method": "log", "id": 7}]`,
+	} {
+		r := received(t, client, cID, "")
+		r.Packet.Properties.ContentType = rpc.JSONRPC.ContentType()
+		r.Packet.Payload = []byte(payload)
+		s.onPublishReceived(r)
+	}
+
+	// Only the request of the mixed batch is answered
+	select {
+	case pb := <-published:
+		if cID := string(pb.Properties.CorrelationData); cID != "batch with requests" {
+			t.Fatalf("expected only the reply to the batch with a request, got %q: %s", cID, pb.Payload)
+		}
+		if resps, err := rpc.JSONRPC.(rpc.BatchFormat).DecodeBatchResponse(pb.Payload); err != nil || len(resps) != 1 {
+			t.Fatalf("expected the reply to hold one response, got %s", pb.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply was published")
+	}
+	nothingPublished(t, s, published)
+	if n := handled.Load(); n != 5 {
+		t.Fatalf("expected 5 calls to be handled, got %d", n)
+	}
+}
+
+func TestJSONRPCDecodeErrorCodes(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1})
+
+	for _, test := range []struct {
+		payload string
+		code    int
+	}{
+		{`{"jsonrpc": `, -32700},
+		{`{"jsonrpc": "1.0", "method": "log", "id": 1}`, -32600},
+		{`{"jsonrpc": "2.0", "id": 1}`, -32600},
+		{`[]`, -32600},
+		{`{"jsonrpc": "2.0", "method": "log", "params": [1], "id": 1}`, -32602},
+	} {
+		r := received(t, client, "1", "")
+		r.Packet.Properties.ContentType = rpc.JSONRPC.ContentType()
+		r.Packet.Payload = []byte(test.payload)
+		s.onPublishReceived(r)
+
+		select {
+		case pb := <-published:
+			var reply struct {
+				Error struct {
+					Code int `json:"code"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(pb.Payload, &reply); err != nil || reply.Error.Code != test.code {
+				t.Fatalf("%s: expected error code %d, got %s", test.payload, test.code, pb.Payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no reply was published", test.payload)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package rpcserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+)
+
+// errCanceled is returned when publishing the reply to a request which the client has
+// cancelled
+var errCanceled = errors.New("request cancelled by the client")
+
+// activeCall is a request which has been queued and not yet answered
+type activeCall struct {
+	cancel   context.CancelFunc // set once a worker starts handling the request
+	canceled bool
+
+	// authorization of the request, which a cancel message must repeat, since cancels
+	// are not passed through the interceptors which authenticate requests
+	authorization string
+}
+
+// callKey identifies a request by its response topic and correlation data, which
+// are repeated by the message cancelling it
+func callKey(received paho.PublishReceived) string {
+	props := received.Packet.Properties
+	return props.ResponseTopic + "\x00" + string(props.CorrelationData)
+}
+
+// start returns the context in which the request is handled, which is cancelled when
+// the client cancels the request. It returns false when the request has already been
+// cancelled
+func (s *Server) start(ctx context.Context, received paho.PublishReceived) (context.Context, context.CancelFunc, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	call := s.active[callKey(received)]
+	if call == nil {
+		return ctx, cancel, true
+	}
+	call.cancel = cancel
+	return ctx, cancel, !call.canceled
+}
+
+func (s *Server) untrack(received paho.PublishReceived) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, callKey(received))
+}
+
+// cancelCall cancels the context of the request which the cancel message refers to.
+// Requests which are not known, because they have already been answered or were
+// received by another server of the group, are ignored, as are cancels without the
+// authorization of the request
+func (s *Server) cancelCall(received paho.PublishReceived) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	call := s.active[callKey(received)]
+	if call == nil {
+		return
+	}
+	authorization := received.Packet.Properties.User.Get(rpc.AuthorizationProperty)
+	if subtle.ConstantTimeCompare([]byte(authorization), []byte(call.authorization)) != 1 {
+		slog.Info(fmt.Sprintf("ignoring cancel without the authorization of the request: %q", received.Packet.Properties.CorrelationData))
+		return
+	}
+	call.canceled = true
+	if call.cancel != nil {
+		call.cancel()
+	}
+}
+
+func (s *Server) isCanceled(received paho.PublishReceived) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	call := s.active[callKey(received)]
+	return call != nil && call.canceled
+}
@@ -0,0 +1,151 @@
+package rpcserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+)
+
+// cancelMessage returns the message cancelling a request, as delivered by the client
+func cancelMessage(client *paho.Client, cID string) paho.PublishReceived {
+	return paho.PublishReceived{
+		Client: client,
+		Packet: &paho.Publish{
+			Topic: rpc.CancelTopic("request"),
+			Properties: &paho.PublishProperties{
+				CorrelationData: []byte(cID),
+				ResponseTopic:   testResponseTopic,
+				User:            paho.UserProperties{{Key: rpc.KindProperty, Value: rpc.KindCancel}},
+			},
+		},
+	}
+}
+
+// nothingPublished fails the test when a reply is published once the requests in
+// progress are answered
+func nothingPublished(t *testing.T, s *Server, published <-chan *paho.Publish) {
+	t.Helper()
+
+	s.inflight.Wait()
+	select {
+	case pb := <-published:
+		t.Fatalf("unexpected reply %q: %s", pb.Properties.CorrelationData, pb.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCancelWhileQueued(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1})
+
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	s.RegisterContext("slow", blocking(started, release))
+
+	var called atomic.Bool
+	s.RegisterContext("fast", HandlerFunc(func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+		called.Store(true)
+		return response.New(http.StatusOK), false, nil
+	}))
+
+	s.onPublishReceived(received(t, client, "1", "slow"))
+	<-started
+	s.onPublishReceived(received(t, client, "2", "fast"))
+	s.onPublishReceived(cancelMessage(client, "2"))
+	close(release)
+
+	if cID, code := next(t, published); cID != "1" || code != http.StatusOK {
+		t.Fatalf("expected the reply to the slow request, got %q (%d)", cID, code)
+	}
+	nothingPublished(t, s, published)
+	if called.Load() {
+		t.Error("the cancelled request was handled")
+	}
+}
+
+func TestCancelWhileRunning(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1})
+
+	started := make(chan string, 1)
+	canceled := make(chan error, 1)
+	s.RegisterContext("slow", HandlerFunc(func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+		started <- req.Function
+		select {
+		case <-ctx.Done():
+			canceled <- ctx.Err()
+		case <-time.After(5 * time.Second):
+			canceled <- nil
+		}
+		return response.New(http.StatusOK), false, nil
+	}))
+
+	s.onPublishReceived(received(t, client, "1", "slow"))
+	<-started
+	s.onPublishReceived(cancelMessage(client, "1"))
+
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the context of the handler to be cancelled, got %v", err)
+	}
+	nothingPublished(t, s, published)
+}
+
+func TestLateReplyIsDropped(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1})
+
+	// The handler ignores its context, and replies once it has been cancelled
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	s.RegisterContext("slow", blocking(started, release))
+
+	s.onPublishReceived(received(t, client, "1", "slow"))
+	<-started
+	s.onPublishReceived(cancelMessage(client, "1"))
+	close(release)
+
+	nothingPublished(t, s, published)
+}
+
+// authorized returns the message with the authorization user property
+func authorized(received paho.PublishReceived, token string) paho.PublishReceived {
+	received.Packet.Properties.User = append(received.Packet.Properties.User, paho.UserProperty{Key: rpc.AuthorizationProperty, Value: "Bearer " + token})
+	return received
+}
+
+func TestCancelNeedsTheAuthorizationOfTheRequest(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1})
+
+	started := make(chan string, 1)
+	release := []chan struct{}{make(chan struct{}), make(chan struct{})}
+	s.RegisterContext("first", blocking(started, release[0]))
+	s.RegisterContext("second", blocking(started, release[1]))
+
+	// Cancels without the token of the request, or with another, are ignored
+	s.onPublishReceived(authorized(received(t, client, "1", "first"), "alice"))
+	<-started
+	s.onPublishReceived(cancelMessage(client, "1"))
+	s.onPublishReceived(authorized(cancelMessage(client, "1"), "mallory"))
+	close(release[0])
+
+	if cID, code := next(t, published); cID != "1" || code != http.StatusOK {
+		t.Fatalf("expected the request to be answered, got %q (%d)", cID, code)
+	}
+
+	// A cancel with the token of the request cancels it
+	s.onPublishReceived(authorized(received(t, client, "2", "second"), "alice"))
+	<-started
+	s.onPublishReceived(authorized(cancelMessage(client, "2"), "alice"))
+	close(release[1])
+
+	nothingPublished(t, s, published)
+}
@@ -0,0 +1,174 @@
+package rpcserver
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+)
+
+// Deduplicator is implemented by handlers which choose whether duplicates of their
+// requests are suppressed, overriding the Dedup option of the server
+type Deduplicator interface {
+	Deduplicate() bool
+}
+
+// deduplicates reports whether duplicates of requests for the function are suppressed
+func (s *Server) deduplicates(function string) bool {
+	var h any = s.handler(function)
+	if a, ok := h.(handlerAdapter); ok {
+		h = a.h
+	}
+	if d, ok := h.(Deduplicator); ok {
+		return d.Deduplicate()
+	}
+	return s.opts.Dedup
+}
+
+// deduplicate returns an interceptor which answers a duplicate of the request with
+// the result of the original, once there is one, rather than calling the handler. It
+// runs inside the other interceptors, so that the caller has been authenticated
+func (s *Server) deduplicate(received paho.PublishReceived) Interceptor {
+	return func(ctx context.Context, req request.Request, next HandlerFunc) (resp *response.Response, quit bool, err error) {
+
+		e, duplicate := s.dedup.begin(dedupKey(ctx, received))
+		if duplicate {
+			if s.dedup.wait(ctx, e) {
+				slog.Info(fmt.Sprintf("resending the reply to a duplicate request for '%s'", req.Function))
+				return e.resp, false, e.err
+			}
+			slog.Info(fmt.Sprintf("handling a duplicate request for '%s' whose original was not answered", req.Function))
+			return next(ctx, req)
+		}
+
+		// A request which was cancelled, cut short by shutdown or its deadline, or which
+		// panicked, is not answered, so its duplicates are handled afresh
+		finished := false
+		defer func() {
+			if !finished {
+				s.dedup.forget(e)
+			}
+		}()
+
+		resp, quit, err = next(ctx, req)
+		if ctx.Err() == nil {
+			s.dedup.finish(e, resp, err)
+			finished = true
+		}
+		return resp, quit, err
+	}
+}
+
+// dedupKey identifies a request and its duplicates: by its idempotency key when it
+// has one, and otherwise by its correlation data. Both are scoped to the caller, so
+// that another caller cannot be answered with the response: the caller set with
+// WithCaller or, without one, the response topic, which holds the client ID of the
+// requester
+func dedupKey(ctx context.Context, received paho.PublishReceived) string {
+	props := received.Packet.Properties
+	caller := "caller\x00" + Caller(ctx)
+	if Caller(ctx) == "" {
+		caller = "topic\x00" + props.ResponseTopic
+	}
+	if key := props.User.Get(rpc.IdempotencyKeyProperty); key != "" {
+		return caller + "\x00key\x00" + key
+	}
+	return caller + "\x00call\x00" + string(props.CorrelationData)
+}
+
+// dedupCache holds the responses of recent requests, until they expire or the cache
+// is full
+type dedupCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	order   *list.List // of entries, oldest first
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+	done    chan struct{} // closed when the result is set
+	ok      bool
+	resp    *response.Response
+	err     error
+	element *list.Element
+}
+
+func newDedupCache(ttl time.Duration, size int) *dedupCache {
+	return &dedupCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*dedupEntry),
+		order:   list.New(),
+	}
+}
+
+// begin returns the entry for the request, and whether the request is a duplicate
+// of one which has been seen already
+func (c *dedupCache) begin(key string) (*dedupEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		e := front.Value.(*dedupEntry)
+		if c.order.Len() < c.size && now.Before(e.expires) {
+			break
+		}
+		c.remove(e)
+	}
+
+	if e, ok := c.entries[key]; ok {
+		return e, true
+	}
+
+	e := &dedupEntry{key: key, expires: now.Add(c.ttl), done: make(chan struct{})}
+	e.element = c.order.PushBack(e)
+	c.entries[key] = e
+	return e, false
+}
+
+// finish records the result of the request
+func (c *dedupCache) finish(e *dedupEntry, resp *response.Response, err error) {
+	e.ok, e.resp, e.err = true, resp, err
+	close(e.done)
+}
+
+// forget removes the request, whose response is not to be resent, so that a
+// duplicate is handled afresh
+func (c *dedupCache) forget(e *dedupEntry) {
+	c.mu.Lock()
+	if c.entries[e.key] == e {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// remove drops the entry; c.mu must be held
+func (c *dedupCache) remove(e *dedupEntry) {
+	c.order.Remove(e.element)
+	delete(c.entries, e.key)
+}
+
+// wait waits for the result of the original of a duplicate request, and reports
+// whether there is one: false when the original was forgotten or the context is done
+// first
+func (c *dedupCache) wait(ctx context.Context, e *dedupEntry) bool {
+	select {
+	case <-e.done:
+		return e.ok
+	case <-ctx.Done():
+		return false
+	}
+}
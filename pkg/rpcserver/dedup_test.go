@@ -0,0 +1,123 @@
+package rpcserver
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+)
+
+// callerFromProperty is an interceptor which takes the caller from the "caller" user
+// property, as an authenticating interceptor would from a token
+func callerFromProperty(ctx context.Context, req request.Request, next HandlerFunc) (*response.Response, bool, error) {
+	if caller := Properties(ctx).User.Get("caller"); caller != "" {
+		ctx = WithCaller(ctx, caller)
+	}
+	return next(ctx, req)
+}
+
+// fromCaller returns the request with the caller user property
+func fromCaller(received paho.PublishReceived, caller string) paho.PublishReceived {
+	received.Packet.Properties.User = append(received.Packet.Properties.User, paho.UserProperty{Key: "caller", Value: caller})
+	return received
+}
+
+func TestDuplicateIsAnsweredOnce(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1, QueueSize: 4, Dedup: true})
+
+	var calls atomic.Int32
+	s.RegisterContext("count", HandlerFunc(func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+		calls.Add(1)
+		return response.New(http.StatusOK), false, nil
+	}))
+
+	for i := 0; i < 2; i++ {
+		s.onPublishReceived(received(t, client, "1", "count"))
+		if cID, code := next(t, published); cID != "1" || code != http.StatusOK {
+			t.Fatalf("expected reply %q, got %q (%d)", "1", cID, code)
+		}
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected the handler to be called once, got %d", n)
+	}
+}
+
+func TestDuplicatesAreScopedToTheCaller(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1, QueueSize: 4, Dedup: true, Interceptors: []Interceptor{callerFromProperty}})
+
+	var calls atomic.Int32
+	s.RegisterContext("count", HandlerFunc(func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+		calls.Add(1)
+		return response.New(http.StatusOK), false, nil
+	}))
+
+	// The same correlation data from another caller is not a duplicate, even on the
+	// same response topic, and the same caller is recognised on another topic
+	s.onPublishReceived(fromCaller(received(t, client, "1", "count"), "alice"))
+	s.onPublishReceived(fromCaller(received(t, client, "1", "count"), "bob"))
+	moved := fromCaller(received(t, client, "1", "count"), "alice")
+	moved.Packet.Properties.ResponseTopic = "response/other"
+	s.onPublishReceived(moved)
+
+	for i := 0; i < 3; i++ {
+		next(t, published)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("expected the handler to be called twice, got %d", n)
+	}
+}
+
+func TestTypedHandlerChoosesDedup(t *testing.T) {
+	echo := func(ctx context.Context, in struct{}) (struct{}, error) {
+		return in, nil
+	}
+
+	for _, dedup := range []bool{false, true} {
+		s := New(Options{Dedup: dedup})
+		Register(s, "default", echo)
+		Register(s, "on", echo, WithDedup(true))
+		Register(s, "off", echo, WithDedup(false))
+
+		if s.deduplicates("default") != dedup || !s.deduplicates("on") || s.deduplicates("off") {
+			t.Fatalf("with Dedup %t: expected the handlers to choose dedup, got default %t, on %t, off %t",
+				dedup, s.deduplicates("default"), s.deduplicates("on"), s.deduplicates("off"))
+		}
+	}
+}
+
+func TestIdempotencyKeyIsScopedToTheClient(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1, QueueSize: 4, Dedup: true})
+
+	var calls atomic.Int32
+	s.RegisterContext("count", HandlerFunc(func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+		calls.Add(1)
+		return response.New(http.StatusOK), false, nil
+	}))
+
+	// Without authentication, a key is only shared by the requests of one client
+	withKey := func(cID string, responseTopic string) paho.PublishReceived {
+		r := received(t, client, cID, "count")
+		r.Packet.Properties.ResponseTopic = responseTopic
+		r.Packet.Properties.User = append(r.Packet.Properties.User, paho.UserProperty{Key: rpc.IdempotencyKeyProperty, Value: "k"})
+		return r
+	}
+	s.onPublishReceived(withKey("1", "response/a"))
+	s.onPublishReceived(withKey("2", "response/a"))
+	s.onPublishReceived(withKey("3", "response/b"))
+
+	for i := 0; i < 3; i++ {
+		next(t, published)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("expected the handler to be called twice, got %d", n)
+	}
+}
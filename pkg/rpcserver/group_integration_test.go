@@ -0,0 +1,162 @@
+//go:build integration
+
+package rpcserver_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/clientid"
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/testbroker"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcclient"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcserver"
+)
+
+func TestGroupSharesRequests(t *testing.T) {
+	const responders = 3
+	const calls = 30
+
+	config := testbroker.Config(t)
+	requestTopic := clientid.New("test/group")
+
+	// Each request is handled once, by one of the Responders of the group
+	var handled [responders]atomic.Int32
+	ctx := context.Background()
+
+	for i := 0; i < responders; i++ {
+		s := rpcserver.New(rpcserver.Options{Config: config, RequestTopic: requestTopic, Group: "test"})
+		s.RegisterContext("count", rpcserver.HandlerFunc(func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+			handled[i].Add(1)
+			return response.New(http.StatusOK), false, nil
+		}))
+		testbroker.Serve(t, s)
+	}
+
+	// Every reply sent to the requester is counted, to check that there is exactly one
+	// for each request
+	clientConfig := config
+	clientConfig.ClientID = clientid.New("requester")
+	var replies atomic.Int32
+	subscribed := make(chan struct{})
+	var once sync.Once
+	observerConfig := config
+	observerConfig.ClientID = clientid.New("observer")
+	observerConfig.OnConnectionUp = func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
+		if _, err := cm.Subscribe(context.Background(), &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: "response/" + clientConfig.ClientID}},
+		}); err != nil {
+			t.Error(err)
+		}
+		once.Do(func() { close(subscribed) })
+	}
+	observerConfig.OnPublishReceived = []func(paho.PublishReceived) (bool, error){
+		func(paho.PublishReceived) (bool, error) {
+			replies.Add(1)
+			return true, nil
+		},
+	}
+	observer, err := autopaho.NewConnection(ctx, observerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer observer.Disconnect(context.Background())
+	<-subscribed
+
+	dctx, dcancel := context.WithTimeout(ctx, 10*time.Second)
+	defer dcancel()
+	client, err := rpcclient.Dial(dctx, rpcclient.Options{Config: clientConfig, RequestTopic: requestTopic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+
+	for i := 0; i < calls; i++ {
+		cctx, ccancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err := client.Call(cctx, "count", nil)
+		ccancel()
+		if err != nil {
+			t.Fatalf("call %d: %s", i, err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	total := 0
+	for i := range handled {
+		n := int(handled[i].Load())
+		if n == 0 {
+			t.Errorf("responder %d handled no requests", i)
+		}
+		total += n
+	}
+	if total != calls {
+		t.Errorf("expected %d requests to be handled, got %d", calls, total)
+	}
+	if n := int(replies.Load()); n != calls {
+		t.Errorf("expected %d replies, got %d", calls, n)
+	}
+	t.Logf("requests handled by each responder: %d, %d, %d", handled[0].Load(), handled[1].Load(), handled[2].Load())
+}
+
+func TestGroupCancel(t *testing.T) {
+	const responders = 3
+	const calls = 6
+
+	config := testbroker.Config(t)
+	requestTopic := clientid.New("test/group")
+
+	// Whichever Responder of the group has a request, it receives the cancel message,
+	// which ends the handler before the deadline of the request
+	ended := make(chan error, calls)
+	ctx := context.Background()
+
+	for i := 0; i < responders; i++ {
+		s := rpcserver.New(rpcserver.Options{Config: config, RequestTopic: requestTopic, Group: "test"})
+		s.RegisterContext("wait", rpcserver.HandlerFunc(func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+			select {
+			case <-ctx.Done():
+				ended <- ctx.Err()
+			case <-time.After(10 * time.Second):
+				ended <- nil
+			}
+			return response.New(http.StatusOK), false, nil
+		}))
+		testbroker.Serve(t, s)
+	}
+
+	dctx, dcancel := context.WithTimeout(ctx, 10*time.Second)
+	defer dcancel()
+	client, err := rpcclient.Dial(dctx, rpcclient.Options{Config: config, RequestTopic: requestTopic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+
+	for i := 0; i < calls; i++ {
+		cctx, ccancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		_, err := client.Call(cctx, "wait", nil)
+		ccancel()
+		if err == nil {
+			t.Fatalf("call %d: expected the call to time out", i)
+		}
+	}
+
+	for i := 0; i < calls; i++ {
+		select {
+		case err := <-ended:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("expected the request to be cancelled, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d requests ended", i, calls)
+		}
+	}
+}
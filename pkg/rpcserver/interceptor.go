@@ -0,0 +1,91 @@
+package rpcserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+)
+
+// HandlerFunc is a function which is a ContextHandler
+type HandlerFunc func(ctx context.Context, req request.Request) (*response.Response, bool, error)
+
+func (f HandlerFunc) HandleContext(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	return f(ctx, req)
+}
+
+// Interceptor runs around the handler of every request, including the items of a
+// batch and stream handlers. It calls next to continue to the next interceptor and
+// finally the handler, and may change the request or the result, or return without
+// calling next to reject the request
+type Interceptor func(ctx context.Context, req request.Request, next HandlerFunc) (*response.Response, bool, error)
+
+// chain returns the handler wrapped in the interceptors, the first outermost
+func chain(interceptors []Interceptor, h ContextHandler) HandlerFunc {
+	next := HandlerFunc(h.HandleContext)
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+			return interceptor(ctx, req, inner)
+		}
+	}
+	return next
+}
+
+// Recover returns an interceptor which turns a panic into an Internal error. The
+// server always recovers panics, outside all the interceptors, so Recover is only
+// needed for the interceptors before it to see the panic as an error
+func Recover() Interceptor {
+	return func(ctx context.Context, req request.Request, next HandlerFunc) (resp *response.Response, quit bool, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error(fmt.Sprintf("RECOVER handler '%s': %v\n%s", req.Function, r, debug.Stack()))
+				resp, quit, err = nil, false, fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return next(ctx, req)
+	}
+}
+
+// Logging returns an interceptor which logs each request, and the code of its
+// response with how long it took
+func Logging() Interceptor {
+	return func(ctx context.Context, req request.Request, next HandlerFunc) (*response.Response, bool, error) {
+		slog.Info(fmt.Sprintf("request '%s': %v", req.Function, req.Args))
+
+		start := time.Now()
+		resp, quit, err := next(ctx, req)
+		duration := time.Since(start)
+
+		code := rpcerr.CodeOf(err)
+		if err == nil && resp != nil {
+			if n, e := resp.GetCode(); e == nil {
+				code = rpcerr.Code(n)
+			}
+		}
+		slog.Info(fmt.Sprintf("response '%s': %d (%s) in %s", req.Function, int(code), code, duration))
+		return resp, quit, err
+	}
+}
+
+// MaxArgsSize returns an interceptor which rejects requests whose arguments, encoded
+// as JSON, are longer than limit bytes
+func MaxArgsSize(limit int) Interceptor {
+	return func(ctx context.Context, req request.Request, next HandlerFunc) (*response.Response, bool, error) {
+		b, err := json.Marshal(req.Args)
+		if err != nil {
+			return nil, false, rpcerr.Errorf(rpcerr.InvalidArgument, "could not measure arguments: %s", err)
+		}
+		if len(b) > limit {
+			slog.Info(fmt.Sprintf("rejecting request for '%s' because its arguments are %d bytes", req.Function, len(b)))
+			return nil, false, rpcerr.Errorf(rpcerr.InvalidArgument, "arguments are %d bytes, more than the limit of %d", len(b), limit)
+		}
+		return next(ctx, req)
+	}
+}
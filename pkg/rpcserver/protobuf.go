@@ -0,0 +1,49 @@
+package rpcserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// decodeMessage decodes the arguments into a new message of the type of zero: from
+// the serialized message of a request in the Protobuf format, and otherwise from the
+// arguments as the JSON mapping of the message
+func decodeMessage(zero proto.Message, args map[string]interface{}) (proto.Message, error) {
+
+	m := zero.ProtoReflect().New().Interface()
+	if b, ok := args[rpc.ProtobufKey].([]byte); ok {
+		return m, proto.Unmarshal(b, m)
+	}
+
+	j, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	return m, protojson.Unmarshal(j, m)
+}
+
+// encodeMessage puts the message into an ok response: serialized when the request was
+// in the Protobuf format, and otherwise as the fields of the JSON mapping of the message
+func encodeMessage(m proto.Message, serialized bool) (*response.Response, error) {
+
+	if serialized {
+		b, err := proto.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		resp := response.New(http.StatusOK)
+		(*resp)[rpc.ProtobufKey] = b
+		return resp, nil
+	}
+
+	j, err := protojson.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return encodeResult(json.RawMessage(j))
+}
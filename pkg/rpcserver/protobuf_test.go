@@ -0,0 +1,88 @@
+package rpcserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/sourcecontextpb"
+)
+
+func upper(ctx context.Context, in *sourcecontextpb.SourceContext) (*sourcecontextpb.SourceContext, error) {
+	return &sourcecontextpb.SourceContext{FileName: strings.ToUpper(in.FileName)}, nil
+}
+
+func handle(t *testing.T, h ContextHandler, req *request.Request) *response.Response {
+	t.Helper()
+
+	resp, _, err := h.HandleContext(context.Background(), *req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestTypedProtobufHandler(t *testing.T) {
+	s := New(Options{})
+	Register(s, "upper", upper)
+
+	in, err := proto.Marshal(&sourcecontextpb.SourceContext{FileName: "main.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := request.New("upper")
+	req.Args[rpc.ProtobufKey] = in
+
+	resp := handle(t, s.handler("upper"), req)
+
+	result, ok := (*resp)[rpc.ProtobufKey].([]byte)
+	if !ok {
+		t.Fatalf("expected a serialized message, got %v", resp)
+	}
+	var out sourcecontextpb.SourceContext
+	if err := proto.Unmarshal(result, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.FileName != "MAIN.GO" {
+		t.Errorf("expected 'MAIN.GO', got '%s'", out.FileName)
+	}
+}
+
+func TestTypedProtobufHandlerWithJSON(t *testing.T) {
+	s := New(Options{})
+	Register(s, "upper", upper)
+
+	req := request.New("upper")
+	req.Args["fileName"] = "main.go"
+
+	resp := handle(t, s.handler("upper"), req)
+	if fileName, err := resp.GetString("fileName"); err != nil || fileName != "MAIN.GO" {
+		t.Errorf("expected 'MAIN.GO', got '%s' (%v)", fileName, err)
+	}
+
+	req.Args["unknown"] = 1
+	resp = handle(t, s.handler("upper"), req)
+	if code, _ := resp.GetCode(); code != http.StatusBadRequest {
+		t.Errorf("expected an unknown argument to be rejected with 400, got %d", code)
+	}
+}
+
+func TestTypedHandlerRejectsProtobuf(t *testing.T) {
+	s := New(Options{})
+	Register(s, "add", func(ctx context.Context, in struct{ A, B int }) (int, error) {
+		return in.A + in.B, nil
+	})
+
+	req := request.New("add")
+	req.Args[rpc.ProtobufKey] = []byte{}
+
+	resp := handle(t, s.handler("add"), req)
+	if code, _ := resp.GetCode(); code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", code)
+	}
+}
@@ -0,0 +1,776 @@
+/* see:
+ *    https://github.com/eclipse/paho.golang/blob/v0.21.0/autopaho/examples/basics/basics.go
+ *    https://github.com/eclipse/paho.golang/blob/master/autopaho/examples/rpc/main.go
+ */
+
+package rpcserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/internal/clientid"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+)
+
+// Handler handles a single request. The returned bool asks the server to stop
+// once the reply has been sent.
+type Handler interface {
+	Handle(request.Request) (*response.Response, bool, error)
+}
+
+// ContextHandler is a Handler which is passed a context that is cancelled when the
+// deadline of the request passes
+type ContextHandler interface {
+	HandleContext(ctx context.Context, req request.Request) (*response.Response, bool, error)
+}
+
+type handlerAdapter struct {
+	h Handler
+}
+
+func (a handlerAdapter) HandleContext(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	return a.h.Handle(req)
+}
+
+// Options configure a Server
+type Options struct {
+	// Config holds the connection settings. OnConnectionUp and OnPublishReceived are
+	// set by the server; ClientID defaults to a unique ID starting with ClientIDPrefix
+	Config autopaho.ClientConfig
+
+	// ClientIDPrefix is the prefix of the generated client ID (defaults to "listener")
+	ClientIDPrefix string
+
+	// RequestTopic is the topic requests are received on (defaults to "request")
+	RequestTopic string
+
+	// Routing says which requests are received (defaults to rpc.RouteByBody). Requests
+	// routed by body are received on the request topic, and requests routed by topic on
+	// the topic "<RequestTopic>/<function>"
+	Routing rpc.Routing
+
+	// Functions, when routing by topic, limits the function topics subscribed to (by
+	// default every function topic is subscribed to with "<RequestTopic>/+")
+	Functions []string
+
+	// Group, when set, makes the server subscribe to the request topics through MQTT v5
+	// shared subscriptions "$share/<Group>/<topic>", so that the MQTT server shares the
+	// requests out between all the servers in the group
+	Group string
+
+	// Timeout bounds how long a handler may run when the request does not carry a
+	// message expiry interval (0 means no limit)
+	Timeout time.Duration
+
+	// Workers is the number of requests handled concurrently (defaults to the number of CPUs)
+	Workers int
+
+	// QueueSize is the number of requests which may wait for a worker; when the queue
+	// is full further requests are rejected with a 503 (defaults to 64)
+	QueueSize int
+
+	// QoS is the quality of service of the subscription to the request topic
+	QoS byte
+
+	// ReplyQoS is the quality of service with which replies are published
+	ReplyQoS byte
+
+	// BatchConcurrency is the number of items of batch requests handled concurrently,
+	// across all the batches being handled (defaults to Workers)
+	BatchConcurrency int
+
+	// Interceptors run around every handler, in order, the first outermost
+	Interceptors []Interceptor
+
+	// Dedup, when set, suppresses duplicates of requests: a request which has been
+	// received before is answered with the response to the first one rather than being
+	// handled again. Handlers which implement Deduplicator override this. Requests and
+	// their duplicates have the same idempotency key user property or, without one, the
+	// same correlation data, and come from the same caller: the caller set with
+	// WithCaller by an authenticating interceptor or, without one, the same response
+	// topic. Batches and streams are not deduplicated
+	Dedup bool
+
+	// DedupTTL is how long responses are kept for duplicates (defaults to 5 minutes)
+	DedupTTL time.Duration
+
+	// DedupSize is the number of responses kept for duplicates (defaults to 1000)
+	DedupSize int
+
+	// ShutdownTimeout is the grace period given to requests in progress when Serve
+	// stops because its context is cancelled or a handler asks to quit (defaults to 10s)
+	ShutdownTimeout time.Duration
+}
+
+// Server receives requests on the request topic, dispatches them to the registered
+// handlers and publishes the replies to the response topic given in each request
+type Server struct {
+	opts Options
+
+	mu       sync.Mutex
+	handlers map[string]ContextHandler
+	streams  map[string]StreamHandler
+	active   map[string]*activeCall // requests which may be cancelled, by callKey
+	dedup    *dedupCache
+	batch    chan struct{} // a slot for each batch item being handled
+	cm       *autopaho.ConnectionManager
+
+	requests chan paho.PublishReceived
+	inflight sync.WaitGroup // requests which have been queued but not yet answered
+	draining bool           // set once the server stops taking new requests
+	cancel   context.CancelFunc
+
+	rejectionsMu sync.Mutex
+	rejections   []rejection   // replies to requests which are not handled, oldest first
+	rejected     chan struct{} // signalled when a rejection is queued
+
+	ready     chan struct{} // closed once the request topics are subscribed to
+	readyOnce sync.Once
+
+	quit         chan struct{}
+	quitOnce     sync.Once
+	shutdownOnce sync.Once
+	shutdownErr  error
+	drained      chan struct{}
+}
+
+func New(opts Options) *Server {
+	if opts.RequestTopic == "" {
+		opts.RequestTopic = "request"
+	}
+	if opts.Routing == 0 {
+		opts.Routing = rpc.RouteByBody
+	}
+	if opts.ClientIDPrefix == "" {
+		opts.ClientIDPrefix = "listener"
+	}
+	if opts.Config.ClientID == "" {
+		opts.Config.ClientID = clientid.New(opts.ClientIDPrefix)
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.BatchConcurrency <= 0 {
+		opts.BatchConcurrency = opts.Workers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 64
+	}
+	if opts.DedupTTL <= 0 {
+		opts.DedupTTL = 5 * time.Minute
+	}
+	if opts.DedupSize <= 0 {
+		opts.DedupSize = 1000
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = 10 * time.Second
+	}
+
+	return &Server{
+		opts:     opts,
+		handlers: make(map[string]ContextHandler),
+		streams:  make(map[string]StreamHandler),
+		active:   make(map[string]*activeCall),
+		dedup:    newDedupCache(opts.DedupTTL, opts.DedupSize),
+		batch:    make(chan struct{}, opts.BatchConcurrency),
+		requests: make(chan paho.PublishReceived, opts.QueueSize),
+		rejected: make(chan struct{}, 1),
+		ready:    make(chan struct{}),
+		quit:     make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+}
+
+// Register adds a handler for the named function, replacing any existing one
+func (s *Server) Register(name string, h Handler) {
+	s.RegisterContext(name, handlerAdapter{h})
+}
+
+// RegisterContext adds a context aware handler for the named function, replacing any existing one
+func (s *Server) RegisterContext(name string, h ContextHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[name] = h
+	delete(s.streams, name)
+}
+
+func (s *Server) handler(name string) ContextHandler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handlers[name]
+}
+
+// Serve connects to the MQTT server and handles requests until the context is
+// cancelled, Shutdown is called or a handler asks to quit. The server is then shut
+// down, giving requests in progress the ShutdownTimeout to complete.
+func (s *Server) Serve(ctx context.Context) error {
+	if s.opts.QoS > 2 || s.opts.ReplyQoS > 2 {
+		return fmt.Errorf("unexpected qos: %d, reply qos: %d", s.opts.QoS, s.opts.ReplyQoS)
+	}
+
+	topics, err := s.subscriptions()
+	if err != nil {
+		return err
+	}
+
+	var subscriptions []paho.SubscribeOptions
+	for _, topic := range topics {
+		subscriptions = append(subscriptions, paho.SubscribeOptions{Topic: topic, QoS: s.opts.QoS})
+	}
+
+	// Cancel messages are still received while draining, so that requests in progress
+	// can be cancelled
+	cancels := rpc.CancelTopic(s.opts.RequestTopic)
+	subscriptions = append(subscriptions, paho.SubscribeOptions{Topic: cancels, QoS: s.opts.QoS})
+
+	config := s.opts.Config
+
+	// Subscribing in OnConnectionUp is the recommended approach because this ensures the subscription is reestablished
+	// following reconnection (the subscription should survive `cliCfg.SessionExpiryInterval` after disconnection,
+	// but in this case that is 0, and it's safer if we don't assume the session survived anyway).
+	config.OnConnectionUp = func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
+		if s.isDraining() {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5*time.Second))
+		defer cancel()
+		if _, err := cm.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: subscriptions,
+		}); err != nil {
+			slog.Info(fmt.Sprintf("listener failed to subscribe (%s). This is likely to mean no messages will be received.", err))
+			return
+		}
+		s.readyOnce.Do(func() { close(s.ready) })
+	}
+	config.OnPublishReceived = append(config.OnPublishReceived, s.onPublishReceived)
+
+	// The workers are not stopped by the context, so that requests in progress can
+	// complete while shutting down.
+	wctx, wcancel := context.WithCancel(context.Background())
+	workers := s.startWorkers(wctx)
+	defer workers.Wait()
+	defer wcancel()
+
+	// The connection is closed by Shutdown, so that replies can still be sent while draining
+	cm, err := autopaho.NewConnection(context.Background(), config)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.cm = cm
+	s.cancel = wcancel
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+	case <-s.quit:
+		slog.Info("Shutting down as requested")
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+	defer cancel()
+	s.Shutdown(sctx)
+
+	<-s.drained
+	return s.shutdownErr
+}
+
+// Ready returns a channel which is closed once Serve has subscribed to the request
+// topics, from when requests published to them are received
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Shutdown stops the server gracefully: it stops taking new requests by unsubscribing
+// from the request topic, lets requests in progress complete until the context is done
+// and then disconnects from the MQTT server. It is safe to call more than once.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return nil
+	}
+
+	s.shutdownOnce.Do(func() {
+		go func() {
+			s.shutdownErr = s.drain(ctx, cm)
+			close(s.drained)
+		}()
+	})
+
+	select {
+	case <-s.drained:
+		return s.shutdownErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) drain(ctx context.Context, cm *autopaho.ConnectionManager) error {
+
+	// Stop taking new requests
+	s.mu.Lock()
+	s.draining = true
+	cancelRequests := s.cancel
+	s.mu.Unlock()
+
+	uctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	topics, _ := s.subscriptions()
+	if _, err := cm.Unsubscribe(uctx, &paho.Unsubscribe{Topics: topics}); err != nil {
+		slog.Info(fmt.Sprintf("listener failed to unsubscribe (%s)", err))
+	}
+
+	// Let the requests in progress complete
+	finished := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		// The handlers still running are cancelled, and their requests answered with a 503
+		slog.Info("requests still in progress at the end of the grace period are being cancelled")
+		cancelRequests()
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+		}
+	}
+	cancelRequests()
+
+	dctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return cm.Disconnect(dctx)
+}
+
+// subscriptions returns the topic filters requests are received with
+func (s *Server) subscriptions() ([]string, error) {
+
+	var topics []string
+	if s.opts.Routing&rpc.RouteByBody != 0 {
+		topics = append(topics, s.opts.RequestTopic)
+	}
+	if s.opts.Routing&rpc.RouteByTopic != 0 {
+		if len(s.opts.Functions) == 0 {
+			topics = append(topics, s.opts.RequestTopic+"/+")
+		}
+		for _, function := range s.opts.Functions {
+			topic, err := rpc.FunctionTopic(s.opts.RequestTopic, function)
+			if err != nil {
+				return nil, err
+			}
+			topics = append(topics, topic)
+		}
+	}
+
+	if s.opts.Group != "" {
+		for i, topic := range topics {
+			topics[i] = fmt.Sprintf("$share/%s/%s", s.opts.Group, topic)
+		}
+	}
+	return topics, nil
+}
+
+// stop asks Serve to shut the server down
+func (s *Server) stop() {
+	s.quitOnce.Do(func() { close(s.quit) })
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// onPublishReceived queues the request for a worker, rejecting it when the queue is
+// full or the server is shutting down
+func (s *Server) onPublishReceived(received paho.PublishReceived) (bool, error) {
+	if received.Packet.Properties == nil || received.Packet.Properties.CorrelationData == nil || received.Packet.Properties.ResponseTopic == "" {
+		return true, nil
+	}
+
+	if received.Packet.Topic == rpc.CancelTopic(s.opts.RequestTopic) || rpc.Kind(received.Packet.Properties) == rpc.KindCancel {
+		slog.Info(fmt.Sprintf("Received cancel: %q", received.Packet.Properties.CorrelationData))
+		s.cancelCall(received)
+		return true, nil
+	}
+
+	slog.Info(fmt.Sprintf("Received request: %s", string(received.Packet.Payload)))
+
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		slog.Info("rejecting request because the server is shutting down")
+		s.reject(received, rpcerr.New(rpcerr.Unavailable, "server is shutting down"))
+		return true, nil
+	}
+	s.inflight.Add(1)
+	s.active[callKey(received)] = &activeCall{authorization: received.Packet.Properties.User.Get(rpc.AuthorizationProperty)}
+	s.mu.Unlock()
+
+	select {
+	case s.requests <- received:
+	default:
+		s.inflight.Done()
+		s.untrack(received)
+		slog.Info("rejecting request because the queue is full")
+		s.reject(received, rpcerr.New(rpcerr.Unavailable, "server is busy"))
+	}
+	return true, nil
+}
+
+// rejection is the reply to a request which is not handled
+type rejection struct {
+	received paho.PublishReceived
+	err      *rpcerr.Error
+}
+
+// reject queues the reply to a request which is not handled. The reply is published
+// by the rejecter, since the paho receive goroutine must not wait for it to be
+// acknowledged. The queue is not bounded, so that every request is answered
+func (s *Server) reject(received paho.PublishReceived, err *rpcerr.Error) {
+	s.rejectionsMu.Lock()
+	s.rejections = append(s.rejections, rejection{received, err})
+	s.rejectionsMu.Unlock()
+
+	select {
+	case s.rejected <- struct{}{}:
+	default:
+	}
+}
+
+// rejecter publishes the replies to rejected requests until the context is cancelled
+func (s *Server) rejecter(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.rejected:
+		}
+
+		s.rejectionsMu.Lock()
+		rejections := s.rejections
+		s.rejections = nil
+		s.rejectionsMu.Unlock()
+
+		for _, r := range rejections {
+			s.reply(r.received, s.format(r.received), nil, r.err.Response())
+		}
+	}
+}
+
+// startWorkers starts the pool of workers which handle requests, so that a slow
+// handler does not hold up other requests or the paho receive loop, and the rejecter.
+// They run until the context is cancelled
+func (s *Server) startWorkers(ctx context.Context) *sync.WaitGroup {
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		s.rejecter(ctx)
+	}()
+	for i := 0; i < s.opts.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.worker(ctx)
+		}()
+	}
+	return &workers
+}
+
+func (s *Server) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case received := <-s.requests:
+			s.handle(ctx, received)
+			s.inflight.Done()
+		}
+	}
+}
+
+// handle dispatches the request to its handler and publishes the reply. Every request
+// is answered, with an error response when the request could not be handled. The reply
+// is published before the server is asked to stop, so a quit request is always answered
+func (s *Server) handle(ctx context.Context, received paho.PublishReceived) {
+
+	defer s.untrack(received)
+	ctx, cancel, ok := s.start(ctx, received)
+	defer cancel()
+	if !ok {
+		slog.Info("dropping request which was cancelled while queued")
+		return
+	}
+	ctx = context.WithValue(ctx, propertiesKey{}, received.Packet.Properties)
+
+	format, err := rpc.FormatFor(received.Packet.Properties.ContentType)
+	if err != nil {
+		slog.Info(fmt.Sprintf("rejecting request: %v", err))
+		s.reply(received, rpc.Native, nil, rpcerr.New(rpcerr.InvalidArgument, err.Error()).Response())
+		return
+	}
+
+	if batch, ok := format.(rpc.BatchFormat); ok && batch.IsBatch(received.Packet.Payload) {
+		s.handleBatch(ctx, received, batch)
+		return
+	}
+
+	req, id, err := format.DecodeRequest(received.Packet.Payload)
+	if err != nil {
+		slog.Info(fmt.Sprintf("rejecting request because message could not be decoded: %v", err))
+		s.replyDecodeError(received, format, id, fmt.Errorf("could not decode request: %w", err))
+		return
+	}
+
+	// A notification is handled, but nothing is published in reply to it
+	_, notification := id.(rpc.Notification)
+
+	stream := &serverStream{s: s, received: received, format: format, id: id}
+	if !notification {
+		ctx = rpc.WithProgress(ctx, func(percent float64, message string) error {
+			return s.progress(received, format, id, percent, message)
+		})
+	}
+
+	resp, quit := s.dispatch(ctx, received, *req, stream)
+
+	if stream.open {
+		stream.end(resp)
+	} else if !notification {
+		s.reply(received, format, id, resp)
+	}
+
+	if quit {
+		s.stop()
+	}
+}
+
+type propertiesKey struct{}
+
+type callerKey struct{}
+
+// WithCaller returns a context identifying the authenticated caller of the request,
+// which interceptors that authenticate requests set so that only the requests of the
+// same caller are taken as duplicates
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// Caller returns the authenticated caller of the request, or "" when it is not known
+func Caller(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// Properties returns the MQTT v5 properties of the request being handled in the
+// context, such as its user properties, or nil outside a request
+func Properties(ctx context.Context) *paho.PublishProperties {
+	props, _ := ctx.Value(propertiesKey{}).(*paho.PublishProperties)
+	return props
+}
+
+// dispatch runs the handler of the request and returns its response, which is an
+// error response when the request could not be handled. A stream handler sends its
+// messages on the stream, which is nil for the items of a batch
+func (s *Server) dispatch(ctx context.Context, received paho.PublishReceived, req request.Request, stream *serverStream) (*response.Response, bool) {
+
+	// A request published to a function topic is for that function, whatever the body says
+	if function, ok := rpc.FunctionFromTopic(s.opts.RequestTopic, received.Packet.Topic); ok {
+		if req.Function != "" && req.Function != function {
+			slog.Info(fmt.Sprintf("rejecting request for '%s' published to the topic of '%s'", req.Function, function))
+			return rpcerr.Errorf(rpcerr.InvalidArgument, "request for '%s' published to the topic of '%s'", req.Function, function).Response(), false
+		}
+		req.Function = function
+	}
+
+	handler := s.handler(req.Function)
+	var interceptors []Interceptor
+	if sh := s.streamHandler(req.Function); sh != nil {
+		if stream == nil {
+			slog.Info(fmt.Sprintf("rejecting batch item because '%s' streams its responses", req.Function))
+			return rpcerr.Errorf(rpcerr.InvalidArgument, "'%s' streams its responses, so cannot be called in a batch", req.Function).Response(), false
+		}
+		stream.open = true
+		handler = streamCall{h: sh, stream: stream}
+	}
+	if handler == nil {
+		slog.Info(fmt.Sprintf("rejecting request because handler not found: %s", req.Function))
+		return rpcerr.Errorf(rpcerr.NotFound, "function not found: '%s'", req.Function).Response(), false
+	}
+
+	// Batches and streams are not deduplicated
+	if stream != nil && !stream.open && s.deduplicates(req.Function) {
+		interceptors = append(interceptors, s.deduplicate(received))
+	}
+
+	rctx, cancel := s.requestContext(ctx, received.Packet.Properties)
+	defer cancel()
+
+	resp, quit, err := s.invoke(rctx, handler, req, interceptors)
+	if err != nil {
+		slog.Info(fmt.Sprintf("handler '%s' failed: %s", req.Function, err))
+		resp = rpcerr.Convert(fmt.Errorf("'%s' failed: %w", req.Function, err)).Response()
+	} else if resp == nil {
+		slog.Info(fmt.Sprintf("handler '%s' did not return a response", req.Function))
+		resp = rpcerr.Errorf(rpcerr.Internal, "'%s' did not return a response", req.Function).Response()
+	}
+	return resp, quit
+}
+
+// format returns the format of the request, which is Native when its content type is
+// not supported
+func (s *Server) format(received paho.PublishReceived) rpc.Format {
+	format, err := rpc.FormatFor(received.Packet.Properties.ContentType)
+	if err != nil {
+		return rpc.Native
+	}
+	return format
+}
+
+// reply publishes the response, in the format of the request, to the response topic
+// of the request
+func (s *Server) reply(received paho.PublishReceived, format rpc.Format, id any, resp *response.Response) {
+
+	body, err := format.EncodeResponse(resp, id)
+	if err != nil {
+		slog.Error(fmt.Sprintf("could not encode response: %s", err))
+		body, _ = format.EncodeResponse(rpcerr.Errorf(rpcerr.Internal, "could not encode response: %s", err).Response(), id)
+	}
+	s.publish(received, format, body, nil)
+}
+
+// replyDecodeError replies to a request which could not be decoded, in the way of the
+// format when it has one. A notification is not answered
+func (s *Server) replyDecodeError(received paho.PublishReceived, format rpc.Format, id any, err error) {
+
+	if _, ok := id.(rpc.Notification); ok {
+		return
+	}
+
+	resp := rpcerr.New(rpcerr.InvalidArgument, err.Error()).Response()
+	f, ok := format.(rpc.DecodeErrorFormat)
+	if !ok {
+		s.reply(received, format, id, resp)
+		return
+	}
+
+	body, encodeErr := f.EncodeDecodeError(resp, err, id)
+	if encodeErr != nil {
+		slog.Error(fmt.Sprintf("could not encode response: %s", encodeErr))
+		s.reply(received, format, id, resp)
+		return
+	}
+	s.publish(received, format, body, nil)
+}
+
+// progress publishes a progress message for the request
+func (s *Server) progress(received paho.PublishReceived, format rpc.Format, id any, percent float64, message string) error {
+
+	resp := response.New(http.StatusOK)
+	resp.PutNumber("percent", percent)
+	resp.PutMessage(message)
+
+	body, err := format.EncodeResponse(resp, id)
+	if err != nil {
+		return fmt.Errorf("could not encode progress: %w", err)
+	}
+	return s.publish(received, format, body, paho.UserProperties{{Key: rpc.KindProperty, Value: rpc.KindProgress}})
+}
+
+// publish sends the body of a reply, with the user properties, to the response topic
+// of the request
+func (s *Server) publish(received paho.PublishReceived, format rpc.Format, body []byte, user paho.UserProperties) error {
+
+	if s.isCanceled(received) {
+		slog.Info("dropping reply to a cancelled request")
+		return errCanceled
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	slog.Info(fmt.Sprintf("Sending reply: %s", body))
+
+	_, err := received.Client.Publish(ctx, &paho.Publish{
+		QoS: s.opts.ReplyQoS,
+		Properties: &paho.PublishProperties{
+			CorrelationData: received.Packet.Properties.CorrelationData,
+			ContentType:     format.ContentType(),
+			User:            user,
+		},
+		Topic:   received.Packet.Properties.ResponseTopic,
+		Payload: body,
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to publish response: %s", err))
+	}
+	return err
+}
+
+// requestContext returns the context for a request, whose deadline is given by the
+// message expiry interval of the request or, failing that, the server timeout
+func (s *Server) requestContext(ctx context.Context, props *paho.PublishProperties) (context.Context, context.CancelFunc) {
+	if props.MessageExpiry != nil && *props.MessageExpiry > 0 {
+		return context.WithTimeout(ctx, time.Duration(*props.MessageExpiry)*time.Second)
+	}
+	if s.opts.Timeout > 0 {
+		return context.WithTimeout(ctx, s.opts.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+type result struct {
+	resp *response.Response
+	quit bool
+	err  error
+}
+
+// invoke runs the handler, inside the interceptors of the server and then the given
+// interceptors, but stops waiting for it when the context is done
+func (s *Server) invoke(ctx context.Context, handler ContextHandler, req request.Request, interceptors []Interceptor) (*response.Response, bool, error) {
+
+	// Panics in the handler or an interceptor are recovered here, so handlers need not
+	// recover themselves
+	all := append([]Interceptor{Recover()}, s.opts.Interceptors...)
+	h := chain(append(all, interceptors...), handler)
+
+	done := make(chan result, 1)
+	go func() {
+		resp, quit, err := h(ctx, req)
+		done <- result{resp, quit, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.resp, r.quit, r.err
+	case <-ctx.Done():
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		slog.Info(fmt.Sprintf("handler '%s' did not complete before the deadline", req.Function))
+		return rpcerr.Errorf(rpcerr.DeadlineExceeded, "'%s' did not complete before the deadline", req.Function).Response(), false, nil
+	}
+
+	return rpcerr.New(rpcerr.Unavailable, "server is shutting down").Response(), false, nil
+}
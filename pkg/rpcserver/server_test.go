@@ -0,0 +1,251 @@
+package rpcserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+)
+
+const testResponseTopic = "response/test"
+
+// newTestClient returns a paho client connected to a fake MQTT server, which records
+// the messages the client publishes
+func newTestClient(t *testing.T) (*paho.Client, <-chan *paho.Publish) {
+	t.Helper()
+
+	conn, server := net.Pipe()
+	published := make(chan *paho.Publish, 100)
+
+	go func() {
+		for {
+			cp, err := packets.ReadPacket(server)
+			if err != nil {
+				return
+			}
+			switch p := cp.Content.(type) {
+			case *packets.Connect:
+				packets.NewControlPacket(packets.CONNACK).WriteTo(server)
+			case *packets.Publish:
+				published <- paho.PublishFromPacketPublish(p)
+				if p.QoS == 1 {
+					ack := packets.NewControlPacket(packets.PUBACK)
+					ack.Content.(*packets.Puback).PacketID = p.PacketID
+					ack.WriteTo(server)
+				}
+			case *packets.Pingreq:
+				packets.NewControlPacket(packets.PINGRESP).WriteTo(server)
+			}
+		}
+	}()
+
+	client := paho.NewClient(paho.ClientConfig{Conn: conn})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Connect(ctx, &paho.Connect{ClientID: "test", CleanStart: true}); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	t.Cleanup(func() {
+		client.Disconnect(&paho.Disconnect{})
+		server.Close()
+	})
+	return client, published
+}
+
+// newTestServer returns a server whose workers run until the end of the test
+func newTestServer(t *testing.T, opts Options) *Server {
+	t.Helper()
+
+	s := New(opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	workers := s.startWorkers(ctx)
+	t.Cleanup(func() {
+		cancel()
+		workers.Wait()
+	})
+	return s
+}
+
+// received returns a request for the function, as delivered by the client
+func received(t *testing.T, client *paho.Client, cID string, function string) paho.PublishReceived {
+	t.Helper()
+
+	body, err := rpc.Native.EncodeRequest(request.New(function), cID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paho.PublishReceived{
+		Client: client,
+		Packet: &paho.Publish{
+			Topic:   "request",
+			Payload: body,
+			Properties: &paho.PublishProperties{
+				CorrelationData: []byte(cID),
+				ResponseTopic:   testResponseTopic,
+				User:            paho.UserProperties{},
+			},
+		},
+	}
+}
+
+// next returns the next reply published, failing the test when there is none
+func next(t *testing.T, published <-chan *paho.Publish) (string, int) {
+	t.Helper()
+
+	select {
+	case pb := <-published:
+		resp, err := rpc.Native.DecodeResponse(pb.Payload)
+		if err != nil {
+			t.Fatalf("could not decode reply: %s", err)
+		}
+		code, _ := resp.GetCode()
+		return string(pb.Properties.CorrelationData), code
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply was published")
+	}
+	return "", 0
+}
+
+// blocking returns a handler which signals started and then waits for release
+func blocking(started chan<- string, release <-chan struct{}) HandlerFunc {
+	return func(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+		started <- req.Function
+		<-release
+		return response.New(http.StatusOK), false, nil
+	}
+}
+
+func fast(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	return response.New(http.StatusOK), false, nil
+}
+
+func TestFastCallOvertakesSlowCall(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 2, QueueSize: 4})
+
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	s.RegisterContext("slow", blocking(started, release))
+	s.RegisterContext("fast", HandlerFunc(fast))
+
+	s.onPublishReceived(received(t, client, "1", "slow"))
+	<-started
+	s.onPublishReceived(received(t, client, "2", "fast"))
+
+	if cID, code := next(t, published); cID != "2" || code != http.StatusOK {
+		t.Fatalf("expected the fast reply first, got %q (%d)", cID, code)
+	}
+
+	close(release)
+	if cID, code := next(t, published); cID != "1" || code != http.StatusOK {
+		t.Fatalf("expected the slow reply, got %q (%d)", cID, code)
+	}
+}
+
+func TestFullQueueIsRejected(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1, QueueSize: 1})
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	s.RegisterContext("slow", blocking(started, release))
+
+	// The first request occupies the only worker and the second fills the queue
+	s.onPublishReceived(received(t, client, "1", "slow"))
+	<-started
+	s.onPublishReceived(received(t, client, "2", "slow"))
+	s.onPublishReceived(received(t, client, "3", "slow"))
+
+	if cID, code := next(t, published); cID != "3" || code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the third request to be rejected with 503, got %q (%d)", cID, code)
+	}
+
+	close(release)
+	for _, expected := range []string{"1", "2"} {
+		if cID, code := next(t, published); cID != expected || code != http.StatusOK {
+			t.Fatalf("expected reply %q, got %q (%d)", expected, cID, code)
+		}
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		expected []string
+	}{
+		{"body", Options{Routing: rpc.RouteByBody}, []string{"request"}},
+		{"topic", Options{Routing: rpc.RouteByTopic}, []string{"request/+"}},
+		{"functions", Options{Routing: rpc.RouteByTopic, Functions: []string{"a", "b"}}, []string{"request/a", "request/b"}},
+		{"group body", Options{Routing: rpc.RouteByBody, Group: "g"}, []string{"$share/g/request"}},
+		{"group topic", Options{Routing: rpc.RouteByTopic, Group: "g"}, []string{"$share/g/request/+"}},
+		{"group both", Options{Routing: rpc.RouteByBody | rpc.RouteByTopic, Group: "g"}, []string{"$share/g/request", "$share/g/request/+"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			topics, err := New(test.opts).subscriptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(topics) != len(test.expected) {
+				t.Fatalf("expected %q, got %q", test.expected, topics)
+			}
+			for i := range topics {
+				if topics[i] != test.expected[i] {
+					t.Fatalf("expected %q, got %q", test.expected, topics)
+				}
+			}
+		})
+	}
+}
+
+func TestServeReturnsWhenTheConnectionFails(t *testing.T) {
+	served := make(chan error, 1)
+	go func() {
+		served <- New(Options{}).Serve(context.Background())
+	}()
+
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Fatal("expected an error without a server URL")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+}
+
+func TestEveryRejectionIsAnswered(t *testing.T) {
+	client, published := newTestClient(t)
+	s := newTestServer(t, Options{Workers: 1, QueueSize: 1})
+
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	defer close(release)
+	s.RegisterContext("slow", blocking(started, release))
+
+	s.onPublishReceived(received(t, client, "busy", "slow"))
+	<-started
+	s.onPublishReceived(received(t, client, "queued", "slow"))
+
+	// Many more requests are rejected than the queue holds
+	const rejected = 50
+	for i := 0; i < rejected; i++ {
+		s.onPublishReceived(received(t, client, fmt.Sprint(i), "slow"))
+	}
+	for i := 0; i < rejected; i++ {
+		if _, code := next(t, published); code != http.StatusServiceUnavailable {
+			t.Fatalf("expected a 503, got %d", code)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package rpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+)
+
+// Stream sends the messages of a streaming response
+type Stream interface {
+	// Send publishes an ok response as the next message of the stream
+	Send(resp *response.Response) error
+}
+
+// StreamHandler handles a request with a stream of messages, sent on the stream,
+// rather than a single response. The stream is ended when the handler returns, with
+// an ok status or, when the handler fails, with its error
+type StreamHandler interface {
+	HandleStream(ctx context.Context, req request.Request, stream Stream) error
+}
+
+// ErrStreamClosed is returned when sending on a stream which has ended
+var ErrStreamClosed = errors.New("stream closed")
+
+// RegisterStream adds a stream handler for the named function, replacing any existing one
+func (s *Server) RegisterStream(name string, h StreamHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[name] = h
+	delete(s.handlers, name)
+}
+
+func (s *Server) streamHandler(name string) StreamHandler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[name]
+}
+
+// serverStream publishes the messages of a stream to the response topic of the
+// request. Each message carries the correlation data of the request and its sequence
+// number, and the stream ends with a message holding its status
+type serverStream struct {
+	s        *Server
+	received paho.PublishReceived
+	format   rpc.Format
+	id       any
+
+	open bool // set when the request is handled by a stream handler
+
+	mu     sync.Mutex
+	seq    int
+	closed bool
+}
+
+func (st *serverStream) Send(resp *response.Response) error {
+	if !resp.Ok() {
+		return fmt.Errorf("stream messages must be ok responses: %v", *resp)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return ErrStreamClosed
+	}
+	return st.send(rpc.KindData, resp)
+}
+
+// end sends the status of the stream, after which nothing more can be sent
+func (st *serverStream) end(resp *response.Response) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return
+	}
+	st.closed = true
+	st.send(rpc.KindEnd, resp)
+}
+
+func (st *serverStream) send(kind string, resp *response.Response) error {
+
+	// The messages of a stream called as a notification are not published
+	if _, ok := st.id.(rpc.Notification); ok {
+		return nil
+	}
+
+	body, err := st.format.EncodeResponse(resp, st.id)
+	if err != nil {
+		return fmt.Errorf("could not encode response: %w", err)
+	}
+
+	user := paho.UserProperties{
+		{Key: rpc.KindProperty, Value: kind},
+		{Key: rpc.SeqProperty, Value: strconv.Itoa(st.seq)},
+	}
+	st.seq++
+	return st.s.publish(st.received, st.format, body, user)
+}
+
+// streamCall runs a stream handler as a ContextHandler, whose response is the status
+// of the stream
+type streamCall struct {
+	h      StreamHandler
+	stream *serverStream
+}
+
+func (c streamCall) HandleContext(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	if err := c.h.HandleStream(ctx, req, c.stream); err != nil {
+		return nil, false, err
+	}
+	return response.New(http.StatusOK), false, nil
+}
@@ -0,0 +1,286 @@
+package rpcserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/request"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/response"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpc"
+	"github.com/rsmaxwell/mqtt-rpc-go/pkg/rpcerr"
+	"google.golang.org/protobuf/proto"
+)
+
+// Register adds a typed handler for the named function. The request arguments are
+// decoded into Req using its json tags; a field is required unless it is a pointer
+// or tagged omitempty. Requests with missing or mistyped arguments are rejected with
+// an InvalidArgument error that lists every problem. The result is marshalled into
+// the response, with a result that is not a JSON object, or which has a field named
+// "code", "message" or "details", being put under "result".
+// An error returned by fn is replied with its code when it is an *rpcerr.Error.
+//
+// When Req and Resp are protobuf messages, requests in the rpc.Protobuf format carry
+// them serialized, and requests in other formats carry their JSON mapping.
+func Register[Req, Resp any](s *Server, name string, fn func(ctx context.Context, in Req) (Resp, error), opts ...RegisterOption) {
+
+	var o registerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var h ContextHandler = &typedHandler[Req, Resp]{fn: fn}
+	if o.dedup != nil {
+		h = dedupHandler{ContextHandler: h, dedup: *o.dedup}
+	}
+	s.RegisterContext(name, h)
+}
+
+// RegisterOption configures a typed handler
+type RegisterOption func(*registerOptions)
+
+type registerOptions struct {
+	dedup *bool
+}
+
+// WithDedup chooses whether duplicates of requests for the handler are suppressed,
+// overriding the Dedup option of the server as a Deduplicator does
+func WithDedup(dedup bool) RegisterOption {
+	return func(o *registerOptions) {
+		o.dedup = &dedup
+	}
+}
+
+// dedupHandler is a handler with the dedup choice given to Register
+type dedupHandler struct {
+	ContextHandler
+	dedup bool
+}
+
+func (h dedupHandler) Deduplicate() bool {
+	return h.dedup
+}
+
+type typedHandler[Req, Resp any] struct {
+	fn func(ctx context.Context, in Req) (Resp, error)
+}
+
+func (h *typedHandler[Req, Resp]) HandleContext(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+
+	var in Req
+	_, serialized := req.Args[rpc.ProtobufKey].([]byte)
+	if zero, ok := any(in).(proto.Message); ok {
+		m, err := decodeMessage(zero, req.Args)
+		if err != nil {
+			return rpcerr.Errorf(rpcerr.InvalidArgument, "invalid arguments: %s", err).Response(), false, nil
+		}
+		in = m.(Req)
+	} else if serialized {
+		return rpcerr.Errorf(rpcerr.InvalidArgument, "'%s' does not take a protobuf message", req.Function).Response(), false, nil
+	} else if problems := decodeArgs(req.Args, &in); len(problems) > 0 {
+		details := make([]any, len(problems))
+		for i, problem := range problems {
+			details[i] = problem
+		}
+		return rpcerr.New(rpcerr.InvalidArgument, fmt.Sprintf("invalid arguments: %s", strings.Join(problems, "; ")), details...).Response(), false, nil
+	}
+
+	out, err := h.fn(ctx, in)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var resp *response.Response
+	if m, ok := any(out).(proto.Message); ok {
+		resp, err = encodeMessage(m, serialized)
+	} else {
+		resp, err = encodeResult(out)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return resp, false, nil
+}
+
+// decodeArgs decodes the arguments into the struct pointed to by in, one field at a
+// time so that every problem can be reported
+func decodeArgs(args map[string]interface{}, in any) []string {
+
+	v := reflect.ValueOf(in).Elem()
+	if v.Kind() != reflect.Struct {
+		if err := remarshal(args, in); err != nil {
+			return []string{describe(err)}
+		}
+		return nil
+	}
+	return decodeFields(args, v)
+}
+
+// decodeFields decodes the arguments into the fields of the struct. The fields of an
+// embedded struct without a json tag are decoded as fields of the outer struct, as
+// encoding/json does
+func decodeFields(args map[string]interface{}, v reflect.Value) []string {
+
+	var problems []string
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		if embedded, ok := embeddedStruct(v.Field(i), field); ok {
+			problems = append(problems, decodeFields(args, embedded)...)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		name, optional := fieldName(field)
+		if name == "-" {
+			continue
+		}
+
+		value, ok := args[name]
+		if !ok || value == nil {
+			if !optional && field.Type.Kind() != reflect.Pointer {
+				problems = append(problems, fmt.Sprintf("missing '%s'", name))
+			}
+			continue
+		}
+
+		if err := remarshal(value, v.Field(i).Addr().Interface()); err != nil {
+			problems = append(problems, fmt.Sprintf("'%s': %s", name, describe(err)))
+		}
+	}
+
+	return problems
+}
+
+// embeddedStruct returns the struct of an embedded field without a json tag, which is
+// allocated when the field is a nil pointer
+func embeddedStruct(value reflect.Value, field reflect.StructField) (reflect.Value, bool) {
+
+	if !field.Anonymous {
+		return reflect.Value{}, false
+	}
+	if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" {
+		return reflect.Value{}, false
+	}
+
+	t := field.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+
+	// An unexported embedded struct has its exported fields decoded, but a pointer
+	// to one cannot be allocated
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			if !field.IsExported() {
+				return reflect.Value{}, false
+			}
+			value.Set(reflect.New(t))
+		}
+		value = value.Elem()
+	}
+	return value, true
+}
+
+func fieldName(field reflect.StructField) (string, bool) {
+	tag, found := field.Tag.Lookup("json")
+	if !found {
+		return field.Name, false
+	}
+
+	name, options, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, strings.Contains(","+options+",", ",omitempty,")
+}
+
+func remarshal(from any, to any) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, to)
+}
+
+func describe(err error) string {
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) {
+		return fmt.Sprintf("expected %s, got %s", typeError.Type, typeError.Value)
+	}
+	return err.Error()
+}
+
+// encodeResult puts the fields of the result into an ok response. Whole numbers are
+// kept as integers, so that they are encoded as integers by the binary codecs
+func encodeResult(out any) (*response.Response, error) {
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	result = integers(result)
+
+	resp := response.New(http.StatusOK)
+
+	// A result with a field of the envelope of the response is not merged into it
+	fields, ok := result.(map[string]interface{})
+	if ok {
+		for _, key := range []string{"code", "message", "details"} {
+			if _, reserved := fields[key]; reserved {
+				ok = false
+			}
+		}
+	}
+	if !ok {
+		(*resp)["result"] = result
+		return resp, nil
+	}
+
+	for key, value := range fields {
+		(*resp)[key] = value
+	}
+	resp.PutCode(http.StatusOK)
+	return resp, nil
+}
+
+// integers replaces the numbers in a value decoded with UseNumber by an int64 when
+// the number is whole, and by a float64 otherwise
+func integers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = integers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = integers(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,75 @@
+package rpcserver
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type page struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit,omitempty"`
+}
+
+type Filter struct {
+	Author string `json:"author"`
+}
+
+type listRequest struct {
+	Query string `json:"query"`
+	page
+	*Filter
+	Tagged page `json:"tagged,omitempty"`
+}
+
+func TestDecodeEmbeddedStructs(t *testing.T) {
+	var in listRequest
+	args := map[string]interface{}{"query": "q", "offset": 10, "limit": 5, "author": "a", "tagged": map[string]interface{}{"offset": 1}}
+	if problems := decodeArgs(args, &in); len(problems) > 0 {
+		t.Fatalf("unexpected problems: %q", problems)
+	}
+
+	expected := listRequest{Query: "q", page: page{Offset: 10, Limit: 5}, Filter: &Filter{Author: "a"}, Tagged: page{Offset: 1}}
+	if !reflect.DeepEqual(in, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, in)
+	}
+
+	// The required fields of an embedded struct are required of the request
+	problems := decodeArgs(map[string]interface{}{"query": "q"}, &in)
+	if !reflect.DeepEqual(problems, []string{"missing 'offset'", "missing 'author'"}) {
+		t.Fatalf("unexpected problems: %q", problems)
+	}
+}
+
+func TestEncodeResultKeepsTheEnvelope(t *testing.T) {
+	tests := []struct {
+		name   string
+		out    any
+		nested bool
+	}{
+		{"fields", map[string]any{"sum": 3}, false},
+		{"not an object", 3, true},
+		{"code", map[string]any{"code": 7}, true},
+		{"message", map[string]any{"message": "hello"}, true},
+		{"details", map[string]any{"details": []any{}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := encodeResult(test.out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code, _ := resp.GetCode(); code != http.StatusOK {
+				t.Fatalf("expected code 200, got %d", code)
+			}
+			if _, ok := (*resp)["message"]; ok {
+				t.Fatalf("expected the result to leave the message unset, got %v", *resp)
+			}
+			_, nested := (*resp)["result"]
+			if nested != test.nested {
+				t.Fatalf("expected the result to be nested: %t, got %v", test.nested, *resp)
+			}
+		})
+	}
+}
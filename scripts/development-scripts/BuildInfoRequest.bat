@@ -4,4 +4,4 @@ setlocal
 cd %~dp0
 
 echo on
-BuildInfoRequest.exe -username %MQTT_USERNAME% -password %MQTT_PASSWORD%
+mqtt-rpc.exe call -username %MQTT_USERNAME% -password %MQTT_PASSWORD% -function buildinfo
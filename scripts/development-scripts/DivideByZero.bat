@@ -4,4 +4,4 @@ setlocal
 cd %~dp0
 
 echo on
-CalculatorRequest.exe -username %MQTT_USERNAME% -password %MQTT_PASSWORD% -operation div -param1 10 -param2 0
+mqtt-rpc.exe call -username %MQTT_USERNAME% -password %MQTT_PASSWORD% -function calculator -arg operation=div -arg param1:int=10 -arg param2:int=0
@@ -4,4 +4,4 @@ setlocal
 cd %~dp0
 
 echo on
-QuitRequest.exe -username %MQTT_USERNAME% -password %MQTT_PASSWORD%
+mqtt-rpc.exe call -username %MQTT_USERNAME% -password %MQTT_PASSWORD% -function quit -arg quit:bool=true